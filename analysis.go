@@ -0,0 +1,229 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/z-sk1/ayla-lang/parser"
+	"github.com/z-sk1/ayla-lang/token"
+)
+
+// Analysis is everything the server knows about one version of a document.
+// it is built once per version and shared by every feature handler, so it
+// must not be modified once built.
+type Analysis struct {
+	Version int
+	Text    string
+
+	Program     []parser.Statement
+	Tokens      []token.Token
+	ParseErrors []error
+
+	// Root is the file scope. every use in it is linked to its symbol and
+	// symbols without a declared type carry their inferred one.
+	Root           *Scope
+	SemanticErrors []*SemanticError
+	TypeErrors     []*TypeError
+
+	// symbols finds the symbol an identifier token declares or refers to
+	symbols map[token.Token]*Symbol
+}
+
+func analyze(text string, version int) *Analysis {
+	program, toks, parseErrors := parseDocument(text)
+	root, semErrors := BuildSymbols(program, toks)
+
+	inferSymbolTypes(root)
+	symbols := indexSymbols(root)
+	typeErrors := checkTypes(program, toks, root, symbols)
+
+	return &Analysis{
+		Version:        version,
+		Text:           text,
+		Program:        program,
+		Tokens:         toks,
+		ParseErrors:    parseErrors,
+		Root:           root,
+		SemanticErrors: semErrors,
+		TypeErrors:     typeErrors,
+		symbols:        symbols,
+	}
+}
+
+// SymbolFor returns the symbol ident declares or refers to, or nil.
+func (a *Analysis) SymbolFor(ident *parser.Identifier) *Symbol {
+	return a.symbols[ident.Token]
+}
+
+// inferSymbolTypes infers the type of every symbol without a declared one,
+// and the return types of functions declaring none. symbols are done in
+// source order, so a value naming an earlier symbol sees its inferred type.
+// a value calling a function declared later, or a function returning a
+// value inferred later, is picked up by another round.
+func inferSymbolTypes(root *Scope) {
+	var syms, fns []*Symbol
+	var walk func(scope *Scope)
+	walk = func(scope *Scope) {
+		for _, sym := range scope.Symbols {
+			switch {
+			case sym.Kind == SymFunc && len(sym.Returns) == 0:
+				fns = append(fns, sym)
+			case sym.Type == nil && sym.Value != nil:
+				syms = append(syms, sym)
+			}
+		}
+		for _, child := range scope.Children {
+			walk(child)
+		}
+	}
+	walk(root)
+
+	for _, list := range [][]*Symbol{syms, fns} {
+		sort.SliceStable(list, func(i, j int) bool {
+			return posBefore(symbolPos(list[i]), symbolPos(list[j]))
+		})
+	}
+
+	for round := 0; round < 3; round++ {
+		changed := false
+
+		for _, sym := range syms {
+			if sym.Inferred == nil {
+				sym.Inferred = valueType(sym)
+				changed = changed || sym.Inferred != nil
+			}
+		}
+
+		for _, fn := range fns {
+			if fn.InferredReturns == nil {
+				fn.InferredReturns = inferReturns(root, fn)
+				changed = changed || fn.InferredReturns != nil
+			}
+		}
+
+		if !changed {
+			break
+		}
+	}
+}
+
+// valueType infers the type of sym from its value. a name declared along
+// with others takes its own part of a tuple or of a call's results.
+func valueType(sym *Symbol) parser.TypeNode {
+	var names []*parser.Identifier
+	switch decl := sym.Decl.(type) {
+	case *parser.MultiVarStatement:
+		names = decl.Names
+	case *parser.MultiVarStatementNoKeyword:
+		names = decl.Names
+	case *parser.MultiConstStatement:
+		names = decl.Names
+	}
+
+	i := -1
+	for j, name := range names {
+		if name == sym.Ident {
+			i = j
+		}
+	}
+	if i < 0 {
+		return inferExprType(sym.Scope, sym.Value)
+	}
+
+	switch value := sym.Value.(type) {
+	case *parser.TupleLiteral:
+		if i < len(value.Values) {
+			return inferExprType(sym.Scope, value.Values[i])
+		}
+
+	case *parser.FuncCall:
+		if fn := sym.Scope.Resolve(value.Name.Value); fn != nil && fn.Kind == SymFunc {
+			if returns := funcReturns(fn); i < len(returns) {
+				return returns[i]
+			}
+		}
+	}
+	return nil
+}
+
+// inferReturns infers the types fn gives back from the first of its return
+// statements whose values all have a known type.
+func inferReturns(root *Scope, fn *Symbol) []parser.TypeNode {
+	decl, ok := fn.Decl.(*parser.FuncStatement)
+	if !ok {
+		return nil
+	}
+
+	var found []parser.TypeNode
+	for _, stmt := range decl.Body {
+		inspect(stmt, func(n parser.Node) bool {
+			switch n := n.(type) {
+			case *parser.FuncStatement:
+				return false
+
+			case *parser.ReturnStatement:
+				if found == nil {
+					found = returnTypes(root.ScopeAt(tokenSpan(n.Token).Start), n)
+				}
+				return false
+			}
+			return found == nil
+		})
+	}
+	return found
+}
+
+// returnTypes returns the types of the values ret gives back, or nil if any
+// of them is unknown.
+func returnTypes(scope *Scope, ret *parser.ReturnStatement) []parser.TypeNode {
+	if len(ret.Values) == 1 {
+		if call, ok := ret.Values[0].(*parser.FuncCall); ok {
+			if fn := scope.Resolve(call.Name.Value); fn != nil && fn.Kind == SymFunc {
+				if returns := funcReturns(fn); len(returns) > 1 {
+					return returns
+				}
+			}
+		}
+	}
+
+	var types []parser.TypeNode
+	for _, value := range ret.Values {
+		t := inferExprType(scope, value)
+		if t == nil {
+			return nil
+		}
+		types = append(types, t)
+	}
+	return types
+}
+
+// symbolPos is where sym is declared, or where its value starts for an
+// implicit symbol.
+func symbolPos(sym *Symbol) Position {
+	if sym.Ident != nil {
+		return identRange(sym.Ident).Start
+	}
+	if base := nodeBase(sym.Value); base != nil {
+		return tokenSpan(base.Token).Start
+	}
+	return Position{}
+}
+
+// Analysis returns the analysis of the document, building it on first use.
+// it is safe to call from several goroutines.
+func (d *Document) Analysis() *Analysis {
+	d.once.Do(func() {
+		d.analysis = analyze(d.Text, d.Version)
+	})
+	return d.analysis
+}
+
+// analysis returns the analysis of an open document, or nil if it is not
+// open.
+func (s *Server) analysis(uri string) *Analysis {
+	doc := s.document(uri)
+	if doc == nil {
+		return nil
+	}
+	// built outside the lock so a slow analysis does not hold up edits
+	return doc.Analysis()
+}
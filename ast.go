@@ -0,0 +1,654 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/z-sk1/ayla-lang/lexer"
+	"github.com/z-sk1/ayla-lang/parser"
+	"github.com/z-sk1/ayla-lang/token"
+)
+
+// isNilNode reports whether n is nil or a typed nil pointer. the parser
+// returns typed nils for statements it failed to parse and still appends
+// them to the program, so a plain n == nil check is not enough.
+func isNilNode(n parser.Node) bool {
+	if n == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(n)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+// inspect walks the tree rooted at n in source order, calling f for every
+// node. children of a node are skipped when f returns false.
+func inspect(n parser.Node, f func(parser.Node) bool) {
+	if isNilNode(n) || !f(n) {
+		return
+	}
+
+	walkList := func(stmts []parser.Statement) {
+		for _, stmt := range stmts {
+			inspect(stmt, f)
+		}
+	}
+
+	switch n := n.(type) {
+	case *parser.VarStatement:
+		inspect(n.Name, f)
+		inspect(n.Type, f)
+		inspect(n.Value, f)
+
+	case *parser.VarStatementBlock:
+		walkList(n.Decls)
+
+	case *parser.VarStatementNoKeyword:
+		inspect(n.Name, f)
+		inspect(n.Value, f)
+
+	case *parser.MultiVarStatement:
+		for _, name := range n.Names {
+			inspect(name, f)
+		}
+		inspect(n.Type, f)
+		inspect(n.Value, f)
+
+	case *parser.MultiVarStatementNoKeyword:
+		for _, name := range n.Names {
+			inspect(name, f)
+		}
+		inspect(n.Value, f)
+
+	case *parser.ConstStatement:
+		inspect(n.Name, f)
+		inspect(n.Type, f)
+		inspect(n.Value, f)
+
+	case *parser.ConstStatementBlock:
+		walkList(n.Decls)
+
+	case *parser.MultiConstStatement:
+		for _, name := range n.Names {
+			inspect(name, f)
+		}
+		inspect(n.Type, f)
+		inspect(n.Value, f)
+
+	case *parser.AssignmentStatement:
+		inspect(n.Name, f)
+		inspect(n.Value, f)
+
+	case *parser.MultiAssignmentStatement:
+		for _, name := range n.Names {
+			inspect(name, f)
+		}
+		inspect(n.Value, f)
+
+	case *parser.IndexAssignmentStatement:
+		inspect(n.Left, f)
+		inspect(n.Index, f)
+		inspect(n.Value, f)
+
+	case *parser.MemberAssignmentStatement:
+		inspect(n.Object, f)
+		inspect(n.Field, f)
+		inspect(n.Value, f)
+
+	case *parser.EnumStatement:
+		inspect(n.Name, f)
+		for _, variant := range n.Variants {
+			inspect(variant, f)
+		}
+
+	case *parser.TypeStatement:
+		inspect(n.Name, f)
+		inspect(n.Type, f)
+
+	case *parser.StructType:
+		for _, field := range n.Fields {
+			if field == nil {
+				continue
+			}
+			inspect(field.Name, f)
+			inspect(field.Type, f)
+		}
+
+	case *parser.ArrayType:
+		inspect(n.Elem, f)
+
+	case *parser.MapType:
+		inspect(n.Key, f)
+		inspect(n.Value, f)
+
+	case *parser.FuncStatement:
+		inspect(n.Name, f)
+		for _, param := range n.Params {
+			inspect(param, f)
+		}
+		for _, ret := range n.ReturnTypes {
+			inspect(ret, f)
+		}
+		walkList(n.Body)
+
+	case *parser.ParametersClause:
+		inspect(n.Name, f)
+		inspect(n.Type, f)
+
+	case *parser.ReturnStatement:
+		for _, value := range n.Values {
+			inspect(value, f)
+		}
+
+	case *parser.ExpressionStatement:
+		inspect(n.Expression, f)
+
+	case *parser.IfStatement:
+		inspect(n.Condition, f)
+		walkList(n.Consequence)
+		walkList(n.Alternative)
+
+	case *parser.ForStatement:
+		inspect(n.Init, f)
+		inspect(n.Condition, f)
+		inspect(n.Post, f)
+		walkList(n.Body)
+
+	case *parser.ForRangeStatement:
+		inspect(n.Key, f)
+		inspect(n.Value, f)
+		inspect(n.Expr, f)
+		walkList(n.Body)
+
+	case *parser.WhileStatement:
+		inspect(n.Condition, f)
+		walkList(n.Body)
+
+	case *parser.SpawnStatement:
+		walkList(n.Body)
+
+	case *parser.WithStatement:
+		inspect(n.Expr, f)
+		walkList(n.Body)
+
+	case *parser.SwitchStatement:
+		inspect(n.Value, f)
+		for _, c := range n.Cases {
+			inspect(c, f)
+		}
+		inspect(n.Default, f)
+
+	case *parser.CaseClause:
+		inspect(n.Expr, f)
+		walkList(n.Body)
+
+	case *parser.DefaultClause:
+		walkList(n.Body)
+
+	case *parser.FuncCall:
+		inspect(n.Name, f)
+		for _, arg := range n.Args {
+			inspect(arg, f)
+		}
+
+	case *parser.StructLiteral:
+		inspect(n.TypeName, f)
+		for _, name := range sortedKeys(n.Fields) {
+			inspect(n.Fields[name], f)
+		}
+
+	case *parser.AnonymousStructLiteral:
+		for _, name := range sortedKeys(n.Fields) {
+			inspect(n.Fields[name], f)
+		}
+
+	case *parser.MemberExpression:
+		inspect(n.Left, f)
+		inspect(n.Field, f)
+
+	case *parser.ArrayLiteral:
+		for _, el := range n.Elements {
+			inspect(el, f)
+		}
+
+	case *parser.MapLiteral:
+		for _, pair := range n.Pairs {
+			inspect(pair.Key, f)
+			inspect(pair.Value, f)
+		}
+
+	case *parser.TupleLiteral:
+		for _, value := range n.Values {
+			inspect(value, f)
+		}
+
+	case *parser.IndexExpression:
+		inspect(n.Left, f)
+		inspect(n.Index, f)
+
+	case *parser.TypeAssertExpression:
+		inspect(n.Expr, f)
+		inspect(n.Type, f)
+
+	case *parser.InterpolatedString:
+		for _, part := range n.Parts {
+			inspect(part, f)
+		}
+
+	case *parser.InfixExpression:
+		inspect(n.Left, f)
+		inspect(n.Right, f)
+
+	case *parser.PrefixExpression:
+		inspect(n.Right, f)
+
+	case *parser.GroupedExpression:
+		inspect(n.Expression, f)
+
+	case *parser.InExpression:
+		inspect(n.Left, f)
+		inspect(n.Right, f)
+	}
+}
+
+func sortedKeys(fields map[string]parser.Expression) []string {
+	keys := make([]string, 0, len(fields))
+	for name := range fields {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// tokenIndex finds the tokens of parsed nodes in the tokens of their
+// document. tokens are unique by position, so they serve as keys.
+type tokenIndex struct {
+	toks  []token.Token
+	index map[token.Token]int
+}
+
+func newTokenIndex(toks []token.Token) *tokenIndex {
+	index := make(map[token.Token]int, len(toks))
+	for i, tok := range toks {
+		index[tok] = i
+	}
+	return &tokenIndex{toks: toks, index: index}
+}
+
+// nodeRange spans every token of n, along with the brackets closing it.
+func (ti *tokenIndex) nodeRange(n parser.Node) Range {
+	first, last := ti.tokenBounds(n)
+	if first < 0 {
+		if base := nodeBase(n); base != nil {
+			return tokenSpan(base.Token)
+		}
+		return Range{}
+	}
+
+	last = ti.closeBrackets(first, last)
+	return Range{Start: tokenSpan(ti.toks[first]).Start, End: tokenSpan(ti.toks[last]).End}
+}
+
+// closeBrackets extends the tokens first to last over the brackets they
+// open and do not close, and returns the new last index. the parser keeps
+// no closing brackets, so a node's own tokens stop short of them.
+func (ti *tokenIndex) closeBrackets(first, last int) int {
+	depth := 0
+	for _, tok := range ti.toks[first : last+1] {
+		depth += bracketDelta(tok)
+	}
+	for depth > 0 && last+1 < len(ti.toks) && ti.toks[last+1].Type != token.EOF {
+		last++
+		depth += bracketDelta(ti.toks[last])
+	}
+	return last
+}
+
+// matching returns the index of the bracket closing the one at open, or of
+// the last token when it is never closed.
+func (ti *tokenIndex) matching(open int) int {
+	depth := 0
+	for i := open; i < len(ti.toks); i++ {
+		depth += bracketDelta(ti.toks[i])
+		if depth == 0 || ti.toks[i].Type == token.EOF {
+			return i
+		}
+	}
+	return len(ti.toks) - 1
+}
+
+func bracketDelta(tok token.Token) int {
+	switch tok.Type {
+	case token.LPAREN, token.LBRACKET, token.LBRACE:
+		return 1
+	case token.RPAREN, token.RBRACKET, token.RBRACE:
+		return -1
+	}
+	return 0
+}
+
+// tokenBounds returns the indexes of the first and last token of n, or -1
+// when none of its tokens are known.
+func (ti *tokenIndex) tokenBounds(n parser.Node) (first, last int) {
+	first, last = -1, -1
+	add := func(f, l int) {
+		if f < 0 {
+			return
+		}
+		if first < 0 || f < first {
+			first = f
+		}
+		if l > last {
+			last = l
+		}
+	}
+
+	inspect(n, func(n parser.Node) bool {
+		switch n := n.(type) {
+		// both carry the token after them, their own first token is the
+		// one before their operand
+		case *parser.PrefixExpression:
+			f, l := ti.tokenBounds(n.Right)
+			if f >= 0 {
+				add(prevToken(ti.toks, f), l)
+			}
+			return false
+
+		case *parser.GroupedExpression:
+			f, l := ti.tokenBounds(n.Expression)
+			if f >= 0 {
+				add(prevToken(ti.toks, f), l)
+			}
+			return false
+		}
+
+		if base := nodeBase(n); base != nil {
+			if i, ok := ti.index[base.Token]; ok {
+				add(i, i)
+			}
+		}
+		return true
+	})
+
+	return first, last
+}
+
+// stmtBounds returns the indexes of the first and last token of stmt, from
+// its keyword to the newline, ';' or unmatched closing bracket ending it.
+func (ti *tokenIndex) stmtBounds(stmt parser.Statement) (first, last int) {
+	first, last = ti.tokenBounds(stmt)
+	if first < 0 {
+		return -1, -1
+	}
+
+	// a for loop keeps the token after four, or range, as its own
+	switch stmt.(type) {
+	case *parser.ForStatement, *parser.ForRangeStatement:
+		for first > 0 && ti.toks[first].Type != token.FOR {
+			first--
+		}
+	}
+
+	depth := 0
+	for _, tok := range ti.toks[first : last+1] {
+		depth += bracketDelta(tok)
+	}
+
+	for last+1 < len(ti.toks) {
+		tok := ti.toks[last+1]
+		if tok.Type == token.EOF {
+			break
+		}
+		if depth == 0 && (tok.Type == token.NEWLINE || tok.Type == token.SEMICOLON) {
+			break
+		}
+
+		delta := bracketDelta(tok)
+		if depth+delta < 0 {
+			break
+		}
+		depth += delta
+		last++
+	}
+
+	return first, last
+}
+
+// parseDocument lexes and parses text, returning the program, its tokens and
+// the parse errors.
+func parseDocument(text string) ([]parser.Statement, []token.Token, []error) {
+	p := parser.New(lexer.New(text))
+	program, errs := parseProgram(p)
+	toks := lexRaw(text)
+
+	src := newSourceText(text)
+	fixInterpolations(program, src, toks)
+
+	for i := range toks {
+		toks[i] = src.rebase(toks[i])
+	}
+	src.rebaseProgram(program)
+	src.rebaseErrors(errs)
+
+	return program, toks, errs
+}
+
+// parseProgram runs the parser. a few syntax errors, such as an unclosed
+// grouping paren, make the parser panic instead of recording an error; those
+// come back as a parse error at the token it stopped on and no program.
+func parseProgram(p *parser.Parser) (program []parser.Statement, errs []error) {
+	defer func() {
+		if r := recover(); r != nil {
+			tok := currentToken(p)
+			program = nil
+			errs = append(p.Errors(), &parser.ParseError{
+				Message: fmt.Sprint(r),
+				Line:    tok.Line,
+				Column:  tok.Column,
+				Token:   tok,
+			})
+		}
+	}()
+
+	return p.ParseProgram(), p.Errors()
+}
+
+// curTokField is where the parser keeps the token it is on. the parser
+// does not export it, so it is found by reflection once, when elen starts: a
+// parser that no longer has the field stops elen there, and fails every
+// test, instead of putting its parse errors at 0:0.
+var curTokField = parserField("curTok", reflect.TypeOf(token.Token{}))
+
+func parserField(name string, typ reflect.Type) []int {
+	field, ok := reflect.TypeOf(parser.Parser{}).FieldByName(name)
+	if !ok || field.Type != typ {
+		panic(fmt.Sprintf("elen: parser.Parser has no %s field of type %s; update currentToken for this ayla-lang version", name, typ))
+	}
+	return field.Index
+}
+
+// currentToken returns the token the parser is on.
+func currentToken(p *parser.Parser) token.Token {
+	cur := reflect.ValueOf(p).Elem().FieldByIndex(curTokField)
+
+	return token.Token{
+		Type:    token.TokenType(cur.FieldByName("Type").String()),
+		Literal: cur.FieldByName("Literal").String(),
+		Line:    int(cur.FieldByName("Line").Int()),
+		Column:  int(cur.FieldByName("Column").Int()),
+	}
+}
+
+// nodeBase returns the NodeBase embedded in n, or nil if it has none.
+func nodeBase(n parser.Node) *parser.NodeBase {
+	if isNilNode(n) {
+		return nil
+	}
+
+	v := reflect.ValueOf(n)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+
+	field := v.Elem().FieldByName("NodeBase")
+	if !field.IsValid() {
+		return nil
+	}
+
+	nb, _ := field.Addr().Interface().(*parser.NodeBase)
+	return nb
+}
+
+type interpPart struct {
+	literal string
+	isExpr  bool
+	offset  int // start of the expression source
+}
+
+// splitInterpolation splits a string literal into its text and ${...}
+// parts the same way the parser does.
+func splitInterpolation(raw string) []interpPart {
+	var parts []interpPart
+	i := 0
+
+	for i < len(raw) {
+		if raw[i] == '$' && i+1 < len(raw) && raw[i+1] == '{' {
+			i += 2
+			start := i
+			depth := 1
+
+			for i < len(raw) && depth > 0 {
+				switch raw[i] {
+				case '{':
+					depth++
+				case '}':
+					depth--
+				}
+				i++
+			}
+
+			parts = append(parts, interpPart{isExpr: true, offset: start})
+		} else {
+			start := i
+			for i < len(raw) && !(raw[i] == '$' && i+1 < len(raw) && raw[i+1] == '{') {
+				i++
+			}
+
+			parts = append(parts, interpPart{literal: raw[start:i]})
+		}
+	}
+
+	return parts
+}
+
+func interpKey(parts []interpPart) string {
+	var sb strings.Builder
+	for _, part := range parts {
+		if part.isExpr {
+			sb.WriteString("\x00$")
+		} else {
+			sb.WriteString("\x00" + part.literal)
+		}
+	}
+	return sb.String()
+}
+
+// fixInterpolations moves the nodes parsed out of "${...}" string parts to
+// their real place in the document. the parser lexes each part on its own,
+// so their tokens start at line 1 relative to the part, and the resulting
+// InterpolatedString does not record which string token it came from. the
+// two are matched up by the literal text around the parts.
+func fixInterpolations(program []parser.Statement, src *sourceText, toks []token.Token) {
+	text, lineStarts := src.text, src.lineStarts
+
+	offsetPos := func(offset int) Position {
+		line := sort.Search(len(lineStarts), func(i int) bool {
+			return lineStarts[i] > offset
+		}) - 1
+		return Position{Line: line, Character: offset - lineStarts[line]}
+	}
+
+	// string tokens holding parts, keyed by their literal text, in
+	// document order
+	pending := make(map[string][][]interpPart)
+
+	for _, tok := range toks {
+		if tok.Type != token.STRING || !strings.Contains(tok.Literal, "${") {
+			continue
+		}
+
+		// the token is not rebased yet, its column is just past the
+		// closing quote
+		if tok.Line < 1 || tok.Line > len(lineStarts) {
+			continue
+		}
+
+		closeQuote := src.end(tok) - 1
+		if closeQuote <= 0 || closeQuote >= len(text) || text[closeQuote] != '"' {
+			continue
+		}
+
+		openQuote := strings.LastIndexByte(text[:closeQuote], '"')
+		if openQuote < 0 {
+			continue
+		}
+
+		rawParts := splitInterpolation(tok.Literal)
+		srcParts := splitInterpolation(text[openQuote+1 : closeQuote])
+		if len(rawParts) != len(srcParts) {
+			continue
+		}
+
+		for i := range srcParts {
+			srcParts[i].offset += openQuote + 1
+		}
+
+		key := interpKey(rawParts)
+		pending[key] = append(pending[key], srcParts)
+	}
+
+	for _, stmt := range program {
+		inspect(stmt, func(n parser.Node) bool {
+			is, ok := n.(*parser.InterpolatedString)
+			if !ok {
+				return true
+			}
+
+			parts := make([]interpPart, len(is.Parts))
+			for i, part := range is.Parts {
+				if lit, ok := part.(*parser.StringLiteral); ok && lit.Token.Line == 0 {
+					parts[i].literal = lit.Value
+				} else {
+					parts[i].isExpr = true
+				}
+			}
+
+			key := interpKey(parts)
+			if len(pending[key]) == 0 {
+				return false
+			}
+			srcParts := pending[key][0]
+			pending[key] = pending[key][1:]
+
+			for i, part := range is.Parts {
+				if !srcParts[i].isExpr {
+					continue
+				}
+
+				base := offsetPos(srcParts[i].offset)
+				inspect(part, func(n parser.Node) bool {
+					nb := nodeBase(n)
+					if nb != nil && nb.Token.Line > 0 {
+						nb.Token.Line += base.Line
+						nb.Token.Column += base.Character
+					}
+					return true
+				})
+			}
+
+			return false
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/z-sk1/ayla-lang/parser"
+)
+
+// TestParsePanic checks a syntax error the parser panics on comes back as a
+// parse error at the token the parser stopped on. that token is read from
+// the parser's unexported state, so this fails if it moves.
+func TestParsePanic(t *testing.T) {
+	tests := []struct {
+		text string
+		want Range
+	}{
+		{"egg x = (1 + 2\nexplodeln(x)\n", Range{Start: Position{Line: 0, Character: 13}, End: Position{Line: 0, Character: 14}}},
+		{"egg x = (1 2)\n", Range{Start: Position{Line: 0, Character: 9}, End: Position{Line: 0, Character: 10}}},
+		{"explodeln((abc\n", Range{Start: Position{Line: 0, Character: 11}, End: Position{Line: 0, Character: 14}}},
+	}
+
+	for _, tt := range tests {
+		program, _, errs := parseDocument(tt.text)
+		if program != nil {
+			t.Errorf("parseDocument(%q) returned a program", tt.text)
+		}
+		if len(errs) != 1 {
+			t.Fatalf("parseDocument(%q): %d errors %v, want 1", tt.text, len(errs), errs)
+		}
+
+		pe, ok := errs[0].(*parser.ParseError)
+		if !ok {
+			t.Fatalf("parseDocument(%q): error %T, want *parser.ParseError", tt.text, errs[0])
+		}
+		if pe.Message != "expected ')'" {
+			t.Errorf("parseDocument(%q): message %q", tt.text, pe.Message)
+		}
+		if got := tokenRange(pe); got != tt.want {
+			t.Errorf("parseDocument(%q): error at %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
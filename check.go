@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checkRules names the kinds of diagnostics, in the order they are found.
+var checkRules = []struct {
+	ID          string
+	Description string
+}{
+	{"syntax", "The file does not parse."},
+	{"semantic", "A name is undefined, unused, redeclared or misused."},
+	{"type", "A value does not have the type its use needs."},
+}
+
+// finding is one diagnostic in one file.
+type finding struct {
+	File string
+	Rule string
+	Diagnostic
+}
+
+type jsonFinding struct {
+	File      string        `json:"file"`
+	Line      int           `json:"line"`
+	Column    int           `json:"column"`
+	EndLine   int           `json:"endLine"`
+	EndColumn int           `json:"endColumn"`
+	Severity  string        `json:"severity"`
+	Rule      string        `json:"rule"`
+	Message   string        `json:"message"`
+	Related   []jsonRelated `json:"related,omitempty"`
+}
+
+type jsonRelated struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver struct {
+		Name           string      `json:"name"`
+		InformationURI string      `json:"informationUri"`
+		Rules          []sarifRule `json:"rules"`
+	} `json:"driver"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID           string          `json:"ruleId"`
+	RuleIndex        int             `json:"ruleIndex"`
+	Level            string          `json:"level"`
+	Message          sarifMessage    `json:"message"`
+	Locations        []sarifLocation `json:"locations"`
+	RelatedLocations []sarifLocation `json:"relatedLocations,omitempty"`
+}
+
+type sarifLocation struct {
+	ID               int           `json:"id,omitempty"`
+	PhysicalLocation sarifPhysical `json:"physicalLocation"`
+	Message          *sarifMessage `json:"message,omitempty"`
+}
+
+type sarifPhysical struct {
+	ArtifactLocation struct {
+		URI string `json:"uri"`
+	} `json:"artifactLocation"`
+	Region sarifRegion `json:"region"`
+}
+
+// sarifRegion counts from 1, in utf-16 code units like the lsp does.
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine"`
+	EndColumn   int `json:"endColumn"`
+}
+
+// runCheck is the check subcommand. it returns the exit status: 0 when no
+// file has errors, 1 when one does and 2 when a file cannot be checked.
+// with --strict warnings count as errors.
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	format := flags.String("format", "text", "output `format`: text, json or sarif")
+	strict := flags.Bool("strict", false, "exit with 1 on warnings as well as errors")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: elen check [--format=text|json|sarif] [--strict] [path ...]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *format != "text" && *format != "json" && *format != "sarif" {
+		fmt.Fprintf(os.Stderr, "elen: unknown format %q\n", *format)
+		return 2
+	}
+
+	// go style "dir/..." patterns name a directory, which is searched
+	// recursively anyway
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	for i, path := range paths {
+		path = strings.TrimSuffix(path, "...")
+		if path == "" {
+			path = "."
+		}
+		paths[i] = path
+	}
+
+	files, err := sourceFiles(paths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "elen: %v\n", err)
+		return 2
+	}
+
+	status := 0
+	var findings []finding
+
+	for _, path := range files {
+		found, err := checkFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "elen: %v\n", err)
+			status = 2
+			continue
+		}
+		findings = append(findings, found...)
+	}
+
+	switch *format {
+	case "json":
+		err = writeJSONFindings(findings)
+	case "sarif":
+		err = writeSARIFFindings(findings)
+	default:
+		writeTextFindings(findings)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "elen: %v\n", err)
+		return 2
+	}
+
+	for _, f := range findings {
+		if status == 0 && (f.Severity == 1 || *strict) {
+			status = 1
+		}
+	}
+	return status
+}
+
+// checkFile analyzes the file at path as the server would and returns its
+// diagnostics in source order.
+func checkFile(path string) (found []finding, err error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: internal error: %v", path, r)
+		}
+	}()
+
+	a := analyze(string(src), 0)
+
+	kinds := [][]Diagnostic{
+		parseDiagnostics(a),
+		semanticDiagnostics(path, a),
+		typeDiagnostics(a),
+	}
+	for i, diagnostics := range kinds {
+		for _, d := range diagnostics {
+			found = append(found, finding{File: path, Rule: checkRules[i].ID, Diagnostic: d})
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return posBefore(found[i].Range.Start, found[j].Range.Start)
+	})
+
+	return found, nil
+}
+
+func writeTextFindings(findings []finding) {
+	for _, f := range findings {
+		fmt.Printf("%s:%d:%d: %s: %s\n", f.File, f.Range.Start.Line+1, f.Range.Start.Character+1,
+			severityName(f.Severity), f.Message)
+
+		for _, rel := range f.RelatedInformation {
+			fmt.Printf("%s:%d:%d: note: %s\n", rel.Location.URI, rel.Location.Range.Start.Line+1,
+				rel.Location.Range.Start.Character+1, rel.Message)
+		}
+	}
+}
+
+func writeJSONFindings(findings []finding) error {
+	out := []jsonFinding{}
+
+	for _, f := range findings {
+		jf := jsonFinding{
+			File:      f.File,
+			Line:      f.Range.Start.Line + 1,
+			Column:    f.Range.Start.Character + 1,
+			EndLine:   f.Range.End.Line + 1,
+			EndColumn: f.Range.End.Character + 1,
+			Severity:  severityName(f.Severity),
+			Rule:      f.Rule,
+			Message:   f.Message,
+		}
+
+		for _, rel := range f.RelatedInformation {
+			jf.Related = append(jf.Related, jsonRelated{
+				File:    rel.Location.URI,
+				Line:    rel.Location.Range.Start.Line + 1,
+				Column:  rel.Location.Range.Start.Character + 1,
+				Message: rel.Message,
+			})
+		}
+
+		out = append(out, jf)
+	}
+
+	return writeIndentedJSON(out)
+}
+
+func writeSARIFFindings(findings []finding) error {
+	run := sarifRun{Results: []sarifResult{}}
+	run.Tool.Driver.Name = "elen"
+	run.Tool.Driver.InformationURI = "https://github.com/z-sk1/elen"
+
+	ruleIndex := make(map[string]int)
+	for i, rule := range checkRules {
+		ruleIndex[rule.ID] = i
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{
+			ID:               rule.ID,
+			ShortDescription: sarifMessage{Text: rule.Description},
+		})
+	}
+
+	for _, f := range findings {
+		result := sarifResult{
+			RuleID:    f.Rule,
+			RuleIndex: ruleIndex[f.Rule],
+			Level:     sarifLevel(f.Severity),
+			Message:   sarifMessage{Text: f.Message},
+			Locations: []sarifLocation{sarifLocationOf(f.File, f.Range)},
+		}
+
+		for i, rel := range f.RelatedInformation {
+			loc := sarifLocationOf(rel.Location.URI, rel.Location.Range)
+			loc.ID = i + 1
+			loc.Message = &sarifMessage{Text: rel.Message}
+			result.RelatedLocations = append(result.RelatedLocations, loc)
+		}
+
+		run.Results = append(run.Results, result)
+	}
+
+	return writeIndentedJSON(sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	})
+}
+
+func sarifLocationOf(path string, r Range) sarifLocation {
+	var loc sarifLocation
+	loc.PhysicalLocation.ArtifactLocation.URI = strings.TrimPrefix(filepath.ToSlash(path), "./")
+	loc.PhysicalLocation.Region = sarifRegion{
+		StartLine:   r.Start.Line + 1,
+		StartColumn: r.Start.Character + 1,
+		EndLine:     r.End.Line + 1,
+		EndColumn:   r.End.Character + 1,
+	}
+	return loc
+}
+
+func writeIndentedJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// severityName names an lsp DiagnosticSeverity.
+func severityName(severity int) string {
+	switch severity {
+	case 2:
+		return "warning"
+	case 3:
+		return "info"
+	case 4:
+		return "hint"
+	}
+	return "error"
+}
+
+func sarifLevel(severity int) string {
+	switch severity {
+	case 2:
+		return "warning"
+	case 3, 4:
+		return "note"
+	}
+	return "error"
+}
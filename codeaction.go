@@ -0,0 +1,611 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/z-sk1/ayla-lang/parser"
+	"github.com/z-sk1/ayla-lang/token"
+)
+
+type CodeActionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Range   Range `json:"range"`
+	Context struct {
+		// kept raw, diagnostics of other servers may not fit ours
+		Diagnostics []json.RawMessage `json:"diagnostics"`
+		Only        []string          `json:"only"`
+	} `json:"context"`
+}
+
+type CodeAction struct {
+	Title       string        `json:"title"`
+	Kind        string        `json:"kind"`
+	Diagnostics []interface{} `json:"diagnostics"`
+	IsPreferred bool          `json:"isPreferred,omitempty"`
+	Edit        WorkspaceEdit `json:"edit"`
+}
+
+// quickFix is an edit that fixes the problem one diagnostic reports.
+type quickFix struct {
+	Title      string
+	Diagnostic Diagnostic
+	Edits      []TextEdit
+	Preferred  bool
+}
+
+func (s *Server) handleCodeAction(req *Request) {
+	var params CodeActionParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	uri := params.TextDocument.URI
+	a := s.analysis(uri)
+	if a == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	actions := []CodeAction{}
+
+	if len(params.Context.Only) > 0 && !containsString(params.Context.Only, "quickfix") {
+		s.sendResponse(req.ID, actions)
+		return
+	}
+
+	for _, fix := range quickFixes(uri, a) {
+		r := fix.Diagnostic.Range
+		if posBefore(r.End, params.Range.Start) || posBefore(params.Range.End, r.Start) {
+			continue
+		}
+
+		// link the fix to the client's copy of its diagnostic when it sent one
+		var diag interface{} = fix.Diagnostic
+		for _, raw := range params.Context.Diagnostics {
+			var d struct {
+				Range   Range  `json:"range"`
+				Message string `json:"message"`
+			}
+			if json.Unmarshal(raw, &d) == nil && d.Range == r && d.Message == fix.Diagnostic.Message {
+				diag = raw
+				break
+			}
+		}
+
+		actions = append(actions, CodeAction{
+			Title:       fix.Title,
+			Kind:        "quickfix",
+			Diagnostics: []interface{}{diag},
+			IsPreferred: fix.Preferred,
+			Edit: WorkspaceEdit{
+				Changes: map[string][]TextEdit{uri: fix.Edits},
+			},
+		})
+	}
+
+	s.sendResponse(req.ID, actions)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// fixer builds the quick fixes for the diagnostics of one analysis.
+type fixer struct {
+	*tokenIndex
+	a     *Analysis
+	lines []string
+}
+
+// quickFixes returns every quick fix for the diagnostics published for a.
+func quickFixes(uri string, a *Analysis) []quickFix {
+	f := &fixer{
+		tokenIndex: newTokenIndex(a.Tokens),
+		a:          a,
+		lines:      strings.Split(a.Text, "\n"),
+	}
+
+	var fixes []quickFix
+	add := func(diag Diagnostic, preferred bool, title string, edits []TextEdit) {
+		if len(edits) > 0 {
+			fixes = append(fixes, quickFix{Title: title, Diagnostic: diag, Edits: edits, Preferred: preferred})
+		}
+	}
+
+	for _, se := range a.SemanticErrors {
+		diag := semanticDiagnostic(uri, se)
+
+		switch se.Code {
+		case codeUndefined:
+			title, edits := f.declare(se.Ident)
+			add(diag, true, title, edits)
+		case codeConstAssign:
+			title, edits := f.constToVar(se.Related)
+			add(diag, true, title, edits)
+		case codeUnused:
+			title, edits := f.removeUnused(se.Ident)
+			add(diag, false, title, edits)
+		case codeMissingField:
+			title, edits := f.addField(se.Ident, se.Related)
+			add(diag, true, title, edits)
+		}
+	}
+
+	for _, te := range a.TypeErrors {
+		if te.Code == codeArgCount {
+			title, edits := f.fixArgCount(te.Range)
+			add(typeDiagnostic(te), true, title, edits)
+		}
+	}
+
+	return fixes
+}
+
+// declare declares the undefined variable ident with egg. the first
+// assignment to it the use can see becomes its declaration, without one the
+// use gets a declaration on the line before.
+func (f *fixer) declare(ident *parser.Identifier) (string, []TextEdit) {
+	title := fmt.Sprintf("Declare %s with egg", ident.Value)
+
+	assigned := make(map[token.Token]bool)
+	for _, stmt := range f.a.Program {
+		inspect(stmt, func(n parser.Node) bool {
+			if as, ok := n.(*parser.AssignmentStatement); ok && as.Name != nil {
+				assigned[as.Name.Token] = true
+			}
+			return true
+		})
+	}
+
+	use := identRange(ident).Start
+	useScope := f.a.Root.ScopeAt(use)
+
+	var decl *Position
+	for _, se := range f.a.SemanticErrors {
+		if se.Code != codeUndefined || se.Ident.Value != ident.Value || !assigned[se.Ident.Token] {
+			continue
+		}
+
+		at := identRange(se.Ident).Start
+		if posBefore(use, at) || !scopeEncloses(f.a.Root.ScopeAt(at), useScope) {
+			continue
+		}
+		if decl == nil || posBefore(at, *decl) {
+			decl = &at
+		}
+	}
+	if decl != nil {
+		return title, []TextEdit{{Range: Range{Start: *decl, End: *decl}, NewText: "egg "}}
+	}
+
+	i, ok := f.index[ident.Token]
+	if !ok {
+		return "", nil
+	}
+	stmt := f.lineStmtAt(i)
+	if stmt == nil {
+		return "", nil
+	}
+
+	first, _ := f.stmtBounds(stmt)
+	line := tokenSpan(f.toks[first]).Start.Line
+	at := Position{Line: line}
+
+	return title, []TextEdit{{
+		Range:   Range{Start: at, End: at},
+		NewText: f.indentOf(line) + "egg " + ident.Value + "\n",
+	}}
+}
+
+// scopeEncloses reports whether inner is outer or nested in it.
+func scopeEncloses(outer, inner *Scope) bool {
+	for sc := inner; sc != nil; sc = sc.Parent {
+		if sc == outer {
+			return true
+		}
+	}
+	return false
+}
+
+// constToVar turns the rock declaring ident into an egg.
+func (f *fixer) constToVar(ident *parser.Identifier) (string, []TextEdit) {
+	if ident == nil {
+		return "", nil
+	}
+	sym := f.a.SymbolFor(ident)
+	if sym == nil {
+		return "", nil
+	}
+
+	var tok token.Token
+	switch d := sym.Decl.(type) {
+	case *parser.ConstStatement:
+		tok = d.Token
+	case *parser.MultiConstStatement:
+		tok = d.Token
+	default:
+		return "", nil
+	}
+
+	// a decl in a rock block has no keyword of its own
+	if tok.Type != token.CONST {
+		return "", nil
+	}
+
+	return fmt.Sprintf("Declare %s with egg instead of rock", sym.Name),
+		[]TextEdit{{Range: tokenSpan(tok), NewText: "egg"}}
+}
+
+// removeUnused removes the declaration of the unused variable ident. a
+// value calling a function is kept so the call still runs.
+func (f *fixer) removeUnused(ident *parser.Identifier) (string, []TextEdit) {
+	sym := f.a.SymbolFor(ident)
+	if sym == nil {
+		return "", nil
+	}
+
+	var value parser.Expression
+	inBlock := false
+	switch d := sym.Decl.(type) {
+	case *parser.VarStatement:
+		value = d.Value
+		inBlock = d.Token.Type != token.VAR
+	case *parser.VarStatementNoKeyword:
+		value = d.Value
+	default:
+		return "", nil
+	}
+
+	first, last := f.stmtBounds(sym.Decl)
+	if first < 0 {
+		return "", nil
+	}
+	title := fmt.Sprintf("Remove unused variable %s", sym.Name)
+
+	if !inBlock && hasCall(value) {
+		if v, _ := f.tokenBounds(value); v > first {
+			r := Range{Start: tokenSpan(f.toks[first]).Start, End: tokenSpan(f.toks[v]).Start}
+			return title, []TextEdit{{Range: r, NewText: ""}}
+		}
+	}
+
+	r := Range{Start: tokenSpan(f.toks[first]).Start, End: tokenSpan(f.toks[last]).End}
+
+	next := f.toks[last+1].Type
+	if f.beginsLine(first) && (next == token.NEWLINE || next == token.EOF) {
+		// the declaration has its lines to itself, so they go with it
+		r.Start.Character = 0
+		if r.End.Line+1 < len(f.lines) {
+			r.End = Position{Line: r.End.Line + 1}
+		} else {
+			r.End.Character = utf16Len(strings.TrimSuffix(f.lines[r.End.Line], "\r"))
+		}
+	} else if next == token.SEMICOLON {
+		// up to the next statement on the line, so no space is left over
+		r.End = tokenSpan(f.toks[last+1]).End
+		if after := f.toks[last+2]; after.Type != token.NEWLINE && after.Type != token.EOF {
+			r.End = tokenSpan(after).Start
+		}
+	}
+
+	return title, []TextEdit{{Range: r, NewText: ""}}
+}
+
+func hasCall(expr parser.Expression) bool {
+	found := false
+	inspect(expr, func(n parser.Node) bool {
+		if _, ok := n.(*parser.FuncCall); ok {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// addField adds the field declared at fieldIdent to the struct literal of
+// the type named by typeName, set to the zero value of its type.
+func (f *fixer) addField(typeName, fieldIdent *parser.Identifier) (string, []TextEdit) {
+	if fieldIdent == nil {
+		return "", nil
+	}
+	field := f.a.SymbolFor(fieldIdent)
+	if field == nil {
+		return "", nil
+	}
+
+	i, ok := f.index[typeName.Token]
+	if !ok || i+1 >= len(f.toks) || f.toks[i+1].Type != token.LBRACE {
+		return "", nil
+	}
+	open := i + 1
+	close := f.matching(open)
+	if f.toks[close].Type != token.RBRACE {
+		return "", nil
+	}
+
+	prev := close - 1
+	for f.toks[prev].Type == token.NEWLINE {
+		prev--
+	}
+
+	scope := f.a.Root.ScopeAt(identRange(typeName).Start)
+	text := field.Name + ": " + zeroValue(scope, field.Type, 0)
+	title := fmt.Sprintf("Add field %s to %s literal", field.Name, typeName.Value)
+
+	openLine := tokenSpan(f.toks[open]).Start.Line
+	closeLine := tokenSpan(f.toks[close]).Start.Line
+	prevLine := tokenSpan(f.toks[prev]).End.Line
+
+	// a literal laid out a field per line gets the field on a line of its own
+	if openLine != closeLine && prevLine < closeLine {
+		var edits []TextEdit
+
+		indent := f.indentOf(closeLine) + indentUnit
+		if prev != open {
+			indent = f.indentOf(prevLine)
+			if f.toks[prev].Type != token.COMMA {
+				end := tokenSpan(f.toks[prev]).End
+				edits = append(edits, TextEdit{Range: Range{Start: end, End: end}, NewText: ","})
+			}
+		}
+
+		at := Position{Line: closeLine}
+		edits = append(edits, TextEdit{Range: Range{Start: at, End: at}, NewText: indent + text + ",\n"})
+		return title, edits
+	}
+
+	switch f.toks[prev].Type {
+	case token.LBRACE:
+	case token.COMMA:
+		text = " " + text
+	default:
+		text = ", " + text
+	}
+
+	at := tokenSpan(f.toks[prev]).End
+	return title, []TextEdit{{Range: Range{Start: at, End: at}, NewText: text}}
+}
+
+// fixArgCount makes the call spanning r pass as many arguments as its
+// function takes, adding zero values for missing ones or removing extras.
+func (f *fixer) fixArgCount(r Range) (string, []TextEdit) {
+	var call *parser.FuncCall
+	for _, stmt := range f.a.Program {
+		inspect(stmt, func(n parser.Node) bool {
+			if c, ok := n.(*parser.FuncCall); ok && c.Name != nil && f.nodeRange(c) == r {
+				call = c
+			}
+			return call == nil
+		})
+	}
+	if call == nil {
+		return "", nil
+	}
+
+	fn := f.a.SymbolFor(call.Name)
+	if fn == nil || fn.Kind != SymFunc {
+		return "", nil
+	}
+
+	i, ok := f.index[call.Name.Token]
+	if !ok || i+1 >= len(f.toks) || f.toks[i+1].Type != token.LPAREN {
+		return "", nil
+	}
+	open := i + 1
+	close := f.matching(open)
+	if f.toks[close].Type != token.RPAREN {
+		return "", nil
+	}
+	last := close - 1
+
+	// the parser drops arguments it cannot read, the fix would miscount
+	if argCount(f.toks[open:close+1]) != len(call.Args) {
+		return "", nil
+	}
+
+	have, want := len(call.Args), len(fn.Params)
+	if fn.Variadic {
+		want--
+	}
+
+	switch {
+	case have < want:
+		scope := f.a.Root.ScopeAt(r.Start)
+
+		var args []string
+		for _, param := range fn.Params[have:want] {
+			args = append(args, zeroValue(scope, param.Type, 0))
+		}
+
+		text := strings.Join(args, ", ")
+		if last != open {
+			text = ", " + text
+		}
+
+		title := fmt.Sprintf("Add missing argument to %s", fn.Name)
+		if len(args) > 1 {
+			title = fmt.Sprintf("Add %d missing arguments to %s", len(args), fn.Name)
+		}
+
+		at := tokenSpan(f.toks[last]).End
+		return title, []TextEdit{{Range: Range{Start: at, End: at}, NewText: text}}
+
+	case have > want && !fn.Variadic:
+		start := tokenSpan(f.toks[open]).End
+		if want > 0 {
+			if isNilNode(call.Args[want-1]) {
+				return "", nil
+			}
+			start = f.nodeRange(call.Args[want-1]).End
+		}
+
+		title := fmt.Sprintf("Remove extra argument to %s", fn.Name)
+		if have-want > 1 {
+			title = fmt.Sprintf("Remove %d extra arguments to %s", have-want, fn.Name)
+		}
+
+		return title, []TextEdit{{Range: Range{Start: start, End: tokenSpan(f.toks[last]).End}, NewText: ""}}
+	}
+
+	return "", nil
+}
+
+// argCount counts the arguments between the brackets of a call by the
+// commas at its top level.
+func argCount(toks []token.Token) int {
+	count, depth := 0, 0
+	empty := true
+
+	for _, tok := range toks[1 : len(toks)-1] {
+		depth += bracketDelta(tok)
+		switch {
+		case tok.Type == token.NEWLINE:
+		case depth == 0 && tok.Type == token.COMMA:
+			count++
+		default:
+			empty = false
+		}
+	}
+
+	if empty {
+		return 0
+	}
+	return count + 1
+}
+
+// zeroValue returns the source of the value a variable of type t starts
+// with, nil when it has none or t is not known. a struct is a literal
+// setting each of its fields.
+func zeroValue(scope *Scope, t parser.TypeNode, depth int) string {
+	switch t := t.(type) {
+	case *parser.ArrayType:
+		return "[]"
+
+	case *parser.IdentType:
+		switch t.Name {
+		case "int":
+			return "0"
+		case "float":
+			return "0.0"
+		case "string":
+			return `""`
+		case "bool":
+			return "no"
+		case "arr":
+			return "[]"
+		}
+
+		// guards against types defined in terms of each other
+		if depth > 8 || scope == nil {
+			return "nil"
+		}
+
+		sym := scope.Resolve(t.Name)
+		if sym == nil || sym.Kind != SymUserType {
+			return "nil"
+		}
+		if st, ok := sym.Type.(*parser.StructType); ok {
+			// an empty literal would be reported for its missing fields
+			var fields []string
+			for _, field := range st.Fields {
+				if field != nil && field.Name != nil {
+					fields = append(fields, field.Name.Value+": "+zeroValue(sym.Scope, field.Type, depth+1))
+				}
+			}
+			return t.Name + "{" + strings.Join(fields, ", ") + "}"
+		}
+		if _, ok := sym.Decl.(*parser.EnumStatement); ok {
+			return "nil"
+		}
+		return zeroValue(sym.Scope, sym.Type, depth+1)
+	}
+
+	return "nil"
+}
+
+// lineStmtAt returns the innermost statement that starts a line and holds
+// the token at i, the one a line can be added before. the decls of a block
+// are left out, the block is the statement.
+func (f *fixer) lineStmtAt(i int) parser.Statement {
+	var found parser.Statement
+	foundFirst := -1
+
+	var walk func(list []parser.Statement)
+	walk = func(list []parser.Statement) {
+		for _, stmt := range list {
+			if isNilNode(stmt) {
+				continue
+			}
+
+			first, last := f.stmtBounds(stmt)
+			if first < 0 || i < first || i > last {
+				continue
+			}
+			if f.beginsLine(first) && first >= foundFirst {
+				found, foundFirst = stmt, first
+			}
+
+			for _, body := range stmtBodies(stmt) {
+				walk(body)
+			}
+		}
+	}
+	walk(f.a.Program)
+
+	return found
+}
+
+// stmtBodies returns the statement lists nested in stmt.
+func stmtBodies(stmt parser.Statement) [][]parser.Statement {
+	switch s := stmt.(type) {
+	case *parser.FuncStatement:
+		return [][]parser.Statement{s.Body}
+	case *parser.IfStatement:
+		return [][]parser.Statement{s.Consequence, s.Alternative}
+	case *parser.ForStatement:
+		return [][]parser.Statement{s.Body}
+	case *parser.ForRangeStatement:
+		return [][]parser.Statement{s.Body}
+	case *parser.WhileStatement:
+		return [][]parser.Statement{s.Body}
+	case *parser.SpawnStatement:
+		return [][]parser.Statement{s.Body}
+	case *parser.WithStatement:
+		return [][]parser.Statement{s.Body}
+	case *parser.SwitchStatement:
+		var bodies [][]parser.Statement
+		for _, c := range s.Cases {
+			if c != nil {
+				bodies = append(bodies, c.Body)
+			}
+		}
+		if s.Default != nil {
+			bodies = append(bodies, s.Default.Body)
+		}
+		return bodies
+	}
+	return nil
+}
+
+// beginsLine reports whether the token at i is the first on its line.
+func (f *fixer) beginsLine(i int) bool {
+	return i == 0 || f.toks[i-1].Type == token.NEWLINE
+}
+
+// indentOf returns the whitespace line starts with.
+func (f *fixer) indentOf(line int) string {
+	if line >= len(f.lines) {
+		return ""
+	}
+	text := f.lines[line]
+	return text[:len(text)-len(strings.TrimLeft(text, " \t"))]
+}
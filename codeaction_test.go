@@ -0,0 +1,193 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+// TestQuickFixes applies a quick fix to each source, compares the result
+// and checks the diagnostic it fixes is gone.
+func TestQuickFixes(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		title string // the fix to apply, "" when none may be offered
+		want  string
+	}{
+		// fixArgCount
+		{
+			name:  "missing argument",
+			src:   "fun add(a, b) {\n    back a + b\n}\nexplodeln(add(1))\n",
+			title: "Add missing argument to add",
+			want:  "fun add(a, b) {\n    back a + b\n}\nexplodeln(add(1, nil))\n",
+		},
+		{
+			name:  "missing typed arguments",
+			src:   "egg a []int = [1]\ninsert(a)\nexplodeln(a)\n",
+			title: "Add 2 missing arguments to insert",
+			want:  "egg a []int = [1]\ninsert(a, 0, nil)\nexplodeln(a)\n",
+		},
+		{
+			name:  "no arguments",
+			src:   "egg a []int = [1]\ninsert()\nexplodeln(a)\n",
+			title: "Add 3 missing arguments to insert",
+			want:  "egg a []int = [1]\ninsert([], 0, nil)\nexplodeln(a)\n",
+		},
+		{
+			name:  "extra arguments",
+			src:   "fun add(a) {\n    back a\n}\nexplodeln(add(1, 2, 3))\n",
+			title: "Remove 2 extra arguments to add",
+			want:  "fun add(a) {\n    back a\n}\nexplodeln(add(1))\n",
+		},
+		{
+			name:  "extra arguments to a function without params",
+			src:   "fun one() {\n    back 1\n}\nexplodeln(one(1, 2))\n",
+			title: "Remove 2 extra arguments to one",
+			want:  "fun one() {\n    back 1\n}\nexplodeln(one())\n",
+		},
+		{
+			name: "variadic",
+			src:  "explodeln(randi(1, 2, 3), toArr())\n",
+		},
+		{
+			// the parser rejects the comma, so the arguments cannot be
+			// counted
+			name: "trailing comma in a call",
+			src:  "fun add(a) {\n    back a\n}\nexplodeln(add(1, 2,))\n",
+		},
+
+		// addField
+		{
+			name:  "field per line",
+			src:   "type P struct {\n    Name string\n    Age int\n}\negg p = P{\n    Name: \"a\",\n}\nexplodeln(p)\n",
+			title: "Add field Age to P literal",
+			want:  "type P struct {\n    Name string\n    Age int\n}\negg p = P{\n    Name: \"a\",\n    Age: 0,\n}\nexplodeln(p)\n",
+		},
+		{
+			name:  "field per line without a trailing comma",
+			src:   "type P struct {\n    Name string\n    Age int\n}\negg p = P{\n    Name: \"a\"\n}\nexplodeln(p)\n",
+			title: "Add field Age to P literal",
+			want:  "type P struct {\n    Name string\n    Age int\n}\negg p = P{\n    Name: \"a\",\n    Age: 0,\n}\nexplodeln(p)\n",
+		},
+		{
+			name:  "empty literal over lines",
+			src:   "type Q struct {\n    X int\n}\ntype P struct {\n    Q Q\n}\nfun f() {\n    egg p = P{\n    }\n    explodeln(p)\n}\nf()\n",
+			title: "Add field Q to P literal",
+			want:  "type Q struct {\n    X int\n}\ntype P struct {\n    Q Q\n}\nfun f() {\n    egg p = P{\n        Q: Q{X: 0},\n    }\n    explodeln(p)\n}\nf()\n",
+		},
+		{
+			name:  "inline literal",
+			src:   "type P struct {\n    Name string\n    Age int\n}\negg p = P{Name: \"a\"}\nexplodeln(p)\n",
+			title: "Add field Age to P literal",
+			want:  "type P struct {\n    Name string\n    Age int\n}\negg p = P{Name: \"a\", Age: 0}\nexplodeln(p)\n",
+		},
+		{
+			name:  "inline literal with a trailing comma",
+			src:   "type P struct {\n    Name string\n    Age int\n}\negg p = P{Name: \"a\",}\nexplodeln(p)\n",
+			title: "Add field Age to P literal",
+			want:  "type P struct {\n    Name string\n    Age int\n}\negg p = P{Name: \"a\", Age: 0}\nexplodeln(p)\n",
+		},
+		{
+			name:  "empty inline literal",
+			src:   "type P struct {\n    Tags []string\n}\negg p = P{}\nexplodeln(p)\n",
+			title: "Add field Tags to P literal",
+			want:  "type P struct {\n    Tags []string\n}\negg p = P{Tags: []}\nexplodeln(p)\n",
+		},
+		{
+			name:  "closing brace after the last field",
+			src:   "type P struct {\n    Name string\n    Ok bool\n}\negg p = P{\n    Name: \"a\"}\nexplodeln(p)\n",
+			title: "Add field Ok to P literal",
+			want:  "type P struct {\n    Name string\n    Ok bool\n}\negg p = P{\n    Name: \"a\", Ok: no}\nexplodeln(p)\n",
+		},
+
+		// declare, constToVar and removeUnused
+		{
+			name:  "assignment becomes the declaration",
+			src:   "x = 1\nexplodeln(x)\n",
+			title: "Declare x with egg",
+			want:  "egg x = 1\nexplodeln(x)\n",
+		},
+		{
+			name:  "declaration before the use",
+			src:   "fun f() {\n    explodeln(y)\n}\nf()\n",
+			title: "Declare y with egg",
+			want:  "fun f() {\n    egg y\n    explodeln(y)\n}\nf()\n",
+		},
+		{
+			name:  "rock to egg",
+			src:   "rock c = 1\nc = 2\nexplodeln(c)\n",
+			title: "Declare c with egg instead of rock",
+			want:  "egg c = 1\nc = 2\nexplodeln(c)\n",
+		},
+		{
+			name:  "unused variable",
+			src:   "fun f() {\n    egg u = 1\n    explodeln(2)\n}\nf()\n",
+			title: "Remove unused variable u",
+			want:  "fun f() {\n    explodeln(2)\n}\nf()\n",
+		},
+		{
+			name:  "unused variable set by a call",
+			src:   "fun f() {\n    egg v = toInt(\"1\")\n}\nf()\n",
+			title: "Remove unused variable v",
+			want:  "fun f() {\n    toInt(\"1\")\n}\nf()\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixes := quickFixes("file:///test.ayla", analyze(tt.src, 1))
+
+			if tt.title == "" {
+				for _, fix := range fixes {
+					t.Errorf("offered %q", fix.Title)
+				}
+				return
+			}
+
+			var fix *quickFix
+			for i := range fixes {
+				if fixes[i].Title == tt.title {
+					fix = &fixes[i]
+					break
+				}
+			}
+			if fix == nil {
+				var titles []string
+				for _, f := range fixes {
+					titles = append(titles, f.Title)
+				}
+				t.Fatalf("no fix %q, have %q", tt.title, titles)
+			}
+
+			got := applyEdits(tt.src, fix.Edits)
+			if got != tt.want {
+				t.Fatalf("after the fix\n got %q\nwant %q", got, tt.want)
+			}
+
+			a := analyze(got, 2)
+			for _, err := range a.ParseErrors {
+				t.Errorf("fixed source does not parse: %v", err)
+			}
+			for _, diag := range append(semanticDiagnostics("file:///test.ayla", a), typeDiagnostics(a)...) {
+				if diag.Severity == 1 || diag.Code == fix.Diagnostic.Code {
+					t.Errorf("fixed source still reports %q", diag.Message)
+				}
+			}
+		})
+	}
+}
+
+// applyEdits applies edits to text the way a client applies the edits of
+// one WorkspaceEdit, each range being in the text before any of them.
+func applyEdits(text string, edits []TextEdit) string {
+	sorted := append([]TextEdit(nil), edits...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return posBefore(sorted[j].Range.Start, sorted[i].Range.Start)
+	})
+
+	for _, edit := range sorted {
+		start, end := offsetAt(text, edit.Range.Start), offsetAt(text, edit.Range.End)
+		text = text[:start] + edit.NewText + text[end:]
+	}
+	return text
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/z-sk1/ayla-lang/parser"
+)
+
+type CompletionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position Position `json:"position"`
+}
+
+type CompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// CompletionItemKind values from the LSP spec
+const (
+	CompletionKindFunction = 3
+	CompletionKindField    = 5
+	CompletionKindVariable = 6
+	CompletionKindClass    = 7
+	CompletionKindEnum     = 13
+	CompletionKindKeyword  = 14
+	CompletionKindConstant = 21
+	CompletionKindStruct   = 22
+)
+
+var keywords = []string{
+	"egg", "rock", "type", "struct", "enum",
+	"ayla", "elen", "decide", "when", "otherwise",
+	"with", "map", "in", "fun", "back", "spawn",
+	"four", "range", "why", "kitkat", "next",
+	"yes", "no", "nil",
+}
+
+func (s *Server) handleCompletion(req *Request) {
+	var params CompletionParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	a := s.analysis(params.TextDocument.URI)
+	if a == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	scope := a.Root.ScopeAt(params.Position)
+
+	var items []CompletionItem
+
+	if chain, ok := memberChainAt(a.Text, params.Position); ok {
+		for _, field := range memberFields(scope, chain) {
+			items = append(items, completionItem(field))
+		}
+	} else {
+		items = scopeCompletions(scope, params.Position)
+		for _, kw := range keywords {
+			items = append(items, CompletionItem{
+				Label: kw,
+				Kind:  CompletionKindKeyword,
+			})
+		}
+	}
+
+	if items == nil {
+		items = []CompletionItem{}
+	}
+
+	s.sendResponse(req.ID, items)
+}
+
+func completionItem(sym *Symbol) CompletionItem {
+	item := CompletionItem{
+		Label:  sym.Name,
+		Detail: symbolSignature(sym),
+	}
+
+	switch sym.Kind {
+	case SymVar, SymParam:
+		item.Kind = CompletionKindVariable
+	case SymConst:
+		item.Kind = CompletionKindConstant
+	case SymFunc:
+		item.Kind = CompletionKindFunction
+	case SymStructField:
+		item.Kind = CompletionKindField
+	case SymType:
+		item.Kind = CompletionKindClass
+	case SymUserType:
+		item.Kind = CompletionKindClass
+		switch t := sym.Type.(type) {
+		case *parser.StructType:
+			item.Kind = CompletionKindStruct
+		case *parser.IdentType:
+			if t.Name == "enum" {
+				item.Kind = CompletionKindEnum
+			}
+		}
+	}
+
+	return item
+}
+
+// scopeCompletions lists every symbol visible at pos, innermost first, with
+// shadowed names left out.
+func scopeCompletions(scope *Scope, pos Position) []CompletionItem {
+	var items []CompletionItem
+	seen := make(map[string]bool)
+
+	for sc := scope; sc != nil; sc = sc.Parent {
+		names := make([]string, 0, len(sc.Symbols))
+		for name := range sc.Symbols {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			sym := sc.Symbols[name]
+			if seen[name] || !visibleAt(sym, scope, pos) {
+				continue
+			}
+			seen[name] = true
+			items = append(items, completionItem(sym))
+		}
+	}
+
+	return items
+}
+
+// visibleAt reports whether sym can be used at pos in scope. a name is usable
+// once its declaration has run, or anywhere in a function body declared in
+// an inner scope, since the body only runs when it is called.
+func visibleAt(sym *Symbol, scope *Scope, pos Position) bool {
+	if sym.Ident == nil || posBefore(identRange(sym.Ident).End, pos) {
+		return true
+	}
+
+	for sc := scope; sc != nil && sc != sym.Scope; sc = sc.Parent {
+		if sc.Owner != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// memberChainAt returns the names before the '.' the cursor is completing
+// after, so "p.addr.ci|" gives ["p", "addr"].
+func memberChainAt(text string, pos Position) ([]string, bool) {
+	lines := strings.Split(text, "\n")
+	if pos.Line < 0 || pos.Line >= len(lines) {
+		return nil, false
+	}
+
+	line := lines[pos.Line]
+	line = line[:offsetAt(line, Position{Character: pos.Character})]
+
+	// drop the partial field name being typed
+	line = strings.TrimRightFunc(line, isIdentRune)
+	if !strings.HasSuffix(line, ".") {
+		return nil, false
+	}
+
+	var chain []string
+	for strings.HasSuffix(line, ".") {
+		line = line[:len(line)-1]
+
+		name := line[len(strings.TrimRightFunc(line, isIdentRune)):]
+		if name == "" {
+			return nil, false
+		}
+
+		chain = append([]string{name}, chain...)
+		line = line[:len(line)-len(name)]
+	}
+
+	return chain, true
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' ||
+		('a' <= r && r <= 'z') ||
+		('A' <= r && r <= 'Z') ||
+		('0' <= r && r <= '9')
+}
+
+// memberFields returns the fields of the value named by chain, following
+// each field to its struct type.
+func memberFields(scope *Scope, chain []string) []*Symbol {
+	sym := scope.Resolve(chain[0])
+	if sym == nil {
+		return nil
+	}
+
+	fields := symbolFieldsOf(sym)
+	for _, name := range chain[1:] {
+		field, ok := fields[name]
+		if !ok {
+			return nil
+		}
+		fields = symbolFieldsOf(field)
+	}
+
+	return sortedFields(fields)
+}
+
+// sortedFields returns the fields in fields ordered by name.
+func sortedFields(fields map[string]*Symbol) []*Symbol {
+	sorted := make([]*Symbol, 0, len(fields))
+	for _, field := range fields {
+		sorted = append(sorted, field)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
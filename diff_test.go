@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		hunks []string
+	}{
+		{
+			name: "same",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+		},
+		{
+			name:  "insert at start",
+			a:     "a\nb\nc\n",
+			b:     "x\na\nb\nc\n",
+			hunks: []string{"@@ -1,3 +1,4 @@"},
+		},
+		{
+			name:  "delete at end",
+			a:     "a\nb\nc\n",
+			b:     "a\nb\n",
+			hunks: []string{"@@ -1,3 +1,2 @@"},
+		},
+		{
+			name:  "changes far apart",
+			a:     numberedLines(1, 20, nil),
+			b:     numberedLines(1, 20, map[int]string{3: "X", 18: "Y"}),
+			hunks: []string{"@@ -1,6 +1,6 @@", "@@ -15,6 +15,6 @@"},
+		},
+		{
+			name:  "changes sharing context",
+			a:     numberedLines(1, 10, nil),
+			b:     numberedLines(1, 10, map[int]string{3: "X", 8: "Y"}),
+			hunks: []string{"@@ -1,10 +1,10 @@"},
+		},
+		{
+			name:  "no newline at end",
+			a:     "a\nb",
+			b:     "a\nc",
+			hunks: []string{"@@ -1,2 +1,2 @@"},
+		},
+		{
+			name:  "newline added at end",
+			a:     "a\nb",
+			b:     "a\nb\n",
+			hunks: []string{"@@ -1,2 +1,2 @@"},
+		},
+		{
+			name:  "from empty",
+			a:     "",
+			b:     "a\n",
+			hunks: []string{"@@ -0,0 +1 @@"},
+		},
+		{
+			name:  "to empty",
+			a:     "a\n",
+			b:     "",
+			hunks: []string{"@@ -1 +0,0 @@"},
+		},
+		{
+			name:  "too many edits to search",
+			a:     numberedLines(1, 1500, nil),
+			b:     strings.ReplaceAll(numberedLines(1, 1500, nil), "line", "row"),
+			hunks: []string{"@@ -1,1500 +1,1500 @@"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := unifiedDiff("a", "b", tt.a, tt.b)
+
+			var hunks []string
+			for _, line := range strings.Split(diff, "\n") {
+				if strings.HasPrefix(line, "@@") {
+					hunks = append(hunks, line)
+				}
+			}
+			if !reflect.DeepEqual(hunks, tt.hunks) {
+				t.Errorf("hunks %q, want %q\n%s", hunks, tt.hunks, diff)
+			}
+
+			if diff != "" {
+				checkPatch(t, tt.a, tt.b, diff)
+			}
+		})
+	}
+}
+
+// checkPatch applies diff to a with patch(1) and checks it gives b.
+func checkPatch(t *testing.T, a, b, diff string) {
+	t.Helper()
+
+	patch, err := exec.LookPath("patch")
+	if err != nil {
+		t.Skip("patch is not installed")
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte(a), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(patch, "-s", "-f", file)
+	cmd.Stdin = strings.NewReader(diff)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("patch: %v\n%s\n%s", err, out, diff)
+	}
+
+	got, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != b {
+		t.Errorf("patched file is %q, want %q", got, b)
+	}
+}
+
+// numberedLines returns lines from to to, numbered, with the ones in
+// replace swapped for their text.
+func numberedLines(from, to int, replace map[int]string) string {
+	var sb strings.Builder
+	for i := from; i <= to; i++ {
+		if text, ok := replace[i]; ok {
+			sb.WriteString(text + "\n")
+			continue
+		}
+		fmt.Fprintf(&sb, "line %d\n", i)
+	}
+	return sb.String()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Document is the server's copy of one version of an open text document.
+// it must not change once the server has stored it, a new version is a new
+// Document.
+type Document struct {
+	URI     string
+	Text    string
+	Version int
+
+	once     sync.Once
+	analysis *Analysis // nil until needed
+}
+
+type TextDocumentContentChangeEvent struct {
+	// Range is nil when Text replaces the whole document.
+	Range *Range `json:"range,omitempty"`
+	Text  string `json:"text"`
+}
+
+// ApplyChange applies one content change to the text of a document that is
+// still being built.
+func (d *Document) ApplyChange(change TextDocumentContentChangeEvent) error {
+	if change.Range == nil {
+		d.Text = change.Text
+		return nil
+	}
+
+	start := offsetAt(d.Text, change.Range.Start)
+	end := offsetAt(d.Text, change.Range.End)
+	if end < start {
+		return fmt.Errorf("invalid change range %d:%d-%d:%d",
+			change.Range.Start.Line, change.Range.Start.Character,
+			change.Range.End.Line, change.Range.End.Character)
+	}
+
+	d.Text = d.Text[:start] + change.Text + d.Text[end:]
+	return nil
+}
+
+// offsetAt converts an LSP position, whose character counts UTF-16 code
+// units, to a byte offset in text. positions past the end of a line or of
+// the text are clamped to it.
+func offsetAt(text string, pos Position) int {
+	offset := 0
+	for line := 0; line < pos.Line; line++ {
+		i := strings.IndexByte(text[offset:], '\n')
+		if i < 0 {
+			return len(text)
+		}
+		offset += i + 1
+	}
+
+	units := 0
+	for units < pos.Character && offset < len(text) {
+		r, size := utf8.DecodeRuneInString(text[offset:])
+		if r == '\n' {
+			break
+		}
+
+		if r >= 0x10000 {
+			units += 2 // surrogate pair
+		} else {
+			units++
+		}
+		offset += size
+	}
+
+	return offset
+}
+
+// endPosition returns the position just past the last character of text.
+func endPosition(text string) Position {
+	line := strings.Count(text, "\n")
+	last := text[strings.LastIndexByte(text, '\n')+1:]
+	return Position{Line: line, Character: utf16Len(last)}
+}
+
+// utf16Len counts the UTF-16 code units of s.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
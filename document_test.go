@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestOffsetAt(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		pos  Position
+		want int
+	}{
+		{"start", "abc\ndef", Position{Line: 0, Character: 0}, 0},
+		{"second line", "abc\ndef", Position{Line: 1, Character: 2}, 6},
+		{"two byte rune", "héllo", Position{Line: 0, Character: 2}, 3},
+		{"surrogate pair", "a😀b", Position{Line: 0, Character: 3}, 5},
+		{"after surrogate pair", "a😀b", Position{Line: 0, Character: 4}, 6},
+		{"inside surrogate pair", "a😀b", Position{Line: 0, Character: 2}, 5},
+		{"past end of line", "abc\ndef", Position{Line: 0, Character: 10}, 3},
+		{"past end of text", "abc\ndef", Position{Line: 1, Character: 10}, 7},
+		{"line past end of text", "abc\ndef", Position{Line: 5, Character: 0}, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := offsetAt(tt.text, tt.pos); got != tt.want {
+				t.Errorf("offsetAt(%q, %v) = %d, want %d", tt.text, tt.pos, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUTF16Len(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"héllo", 5},
+		{"a😀b", 4},
+		{"😀😀", 4},
+	}
+
+	for _, tt := range tests {
+		if got := utf16Len(tt.s); got != tt.want {
+			t.Errorf("utf16Len(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestApplyChange(t *testing.T) {
+	span := func(l1, c1, l2, c2 int) *Range {
+		return &Range{Start: Position{Line: l1, Character: c1}, End: Position{Line: l2, Character: c2}}
+	}
+
+	tests := []struct {
+		name    string
+		text    string
+		changes []TextDocumentContentChangeEvent
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "no changes",
+			text: "egg x = 1\n",
+			want: "egg x = 1\n",
+		},
+		{
+			name:    "whole document",
+			text:    "egg x = 1\n",
+			changes: []TextDocumentContentChangeEvent{{Text: "egg y = 2\n"}},
+			want:    "egg y = 2\n",
+		},
+		{
+			name:    "insert",
+			text:    "egg x = 1\n",
+			changes: []TextDocumentContentChangeEvent{{Range: span(0, 5, 0, 5), Text: "yz"}},
+			want:    "egg xyz = 1\n",
+		},
+		{
+			name:    "after a surrogate pair",
+			text:    "explodeln(\"😀\", x)\n",
+			changes: []TextDocumentContentChangeEvent{{Range: span(0, 16, 0, 17), Text: "y"}},
+			want:    "explodeln(\"😀\", y)\n",
+		},
+		{
+			name:    "replace a surrogate pair",
+			text:    "\"a😀b\"",
+			changes: []TextDocumentContentChangeEvent{{Range: span(0, 2, 0, 4), Text: "é"}},
+			want:    "\"aéb\"",
+		},
+		{
+			name:    "range past end of line",
+			text:    "abc\ndef\n",
+			changes: []TextDocumentContentChangeEvent{{Range: span(0, 1, 0, 99), Text: "X"}},
+			want:    "aX\ndef\n",
+		},
+		{
+			name:    "range past end of text",
+			text:    "abc\ndef",
+			changes: []TextDocumentContentChangeEvent{{Range: span(1, 1, 9, 0), Text: "!"}},
+			want:    "abc\nd!",
+		},
+		{
+			name: "changes in order",
+			text: "egg x = 1\n",
+			changes: []TextDocumentContentChangeEvent{
+				{Range: span(0, 4, 0, 5), Text: "count"},
+				// the second change sees the first one's result
+				{Range: span(0, 12, 0, 13), Text: "2"},
+				{Range: span(1, 0, 1, 0), Text: "explodeln(count)\n"},
+			},
+			want: "egg count = 2\nexplodeln(count)\n",
+		},
+		{
+			name:    "inverted range",
+			text:    "abc\ndef\n",
+			changes: []TextDocumentContentChangeEvent{{Range: span(1, 0, 0, 0), Text: "X"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := &Document{Text: tt.text}
+
+			var err error
+			for _, change := range tt.changes {
+				if err = doc.ApplyChange(change); err != nil {
+					break
+				}
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && doc.Text != tt.want {
+				t.Errorf("text %q, want %q", doc.Text, tt.want)
+			}
+		})
+	}
+}
+
+// TestDidChange checks the server keeps its last good text when a change
+// notification cannot be applied.
+func TestDidChange(t *testing.T) {
+	const uri = "file:///test.ayla"
+
+	notify := func(s *Server, method string, params interface{}) {
+		data, err := json.Marshal(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.handleMessage(&Request{Jsonrpc: "2.0", Method: method, Params: data})
+	}
+	change := func(version int, changes ...TextDocumentContentChangeEvent) map[string]interface{} {
+		if changes == nil {
+			changes = []TextDocumentContentChangeEvent{}
+		}
+		return map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": uri, "version": version},
+			"contentChanges": changes,
+		}
+	}
+
+	var out bytes.Buffer
+	s := NewServer(&bytes.Buffer{}, &out)
+	notify(s, "textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "version": 1, "text": "egg x = 1\n"},
+	})
+
+	steps := []struct {
+		name        string
+		params      map[string]interface{}
+		wantText    string
+		wantVersion int
+		wantLog     bool
+	}{
+		{
+			name:        "no changes",
+			params:      change(2),
+			wantText:    "egg x = 1\n",
+			wantVersion: 2,
+		},
+		{
+			name:        "applied",
+			params:      change(3, TextDocumentContentChangeEvent{Range: &Range{Start: Position{Character: 4}, End: Position{Character: 5}}, Text: "y"}),
+			wantText:    "egg y = 1\n",
+			wantVersion: 3,
+		},
+		{
+			name:        "stale version",
+			params:      change(3, TextDocumentContentChangeEvent{Text: "egg z = 1\n"}),
+			wantText:    "egg y = 1\n",
+			wantVersion: 3,
+			wantLog:     true,
+		},
+		{
+			name: "failing change drops the whole notification",
+			params: change(4,
+				TextDocumentContentChangeEvent{Text: "egg w = 1\n"},
+				TextDocumentContentChangeEvent{Range: &Range{Start: Position{Line: 1}}, Text: "oops"},
+			),
+			wantText:    "egg y = 1\n",
+			wantVersion: 3,
+			wantLog:     true,
+		},
+	}
+
+	for _, step := range steps {
+		out.Reset()
+		notify(s, "textDocument/didChange", step.params)
+
+		doc := s.document(uri)
+		if doc == nil {
+			t.Fatalf("%s: document dropped", step.name)
+		}
+		if doc.Text != step.wantText || doc.Version != step.wantVersion {
+			t.Errorf("%s: have version %d %q, want version %d %q", step.name, doc.Version, doc.Text, step.wantVersion, step.wantText)
+		}
+		if logged := bytes.Contains(out.Bytes(), []byte("window/logMessage")); logged != step.wantLog {
+			t.Errorf("%s: sent a logMessage %v, want %v", step.name, logged, step.wantLog)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runFmt is the fmt subcommand. it returns the exit status: 0 when every
+// file was formatted already, 1 when one was not and 2 on errors.
+func runFmt(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	write := flags.Bool("w", false, "write the result to the file instead of standard output")
+	list := flags.Bool("l", false, "list files whose formatting differs")
+	diff := flags.Bool("d", false, "print a unified diff of the changes instead of the result")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: elen fmt [-w] [-l] [-d] [path ...]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "elen: cannot use -w with standard input")
+			return 2
+		}
+
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "elen: %v\n", err)
+			return 2
+		}
+
+		changed, err := fmtFile("<standard input>", src, *write, *list, *diff)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "elen: %v\n", err)
+			return 2
+		}
+		if changed {
+			return 1
+		}
+		return 0
+	}
+
+	files, err := sourceFiles(flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "elen: %v\n", err)
+		return 2
+	}
+
+	status := 0
+	for _, path := range files {
+		src, err := os.ReadFile(path)
+		if err == nil {
+			var changed bool
+			changed, err = fmtFile(path, src, *write, *list, *diff)
+			if changed && status == 0 {
+				status = 1
+			}
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "elen: %v\n", err)
+			status = 2
+		}
+	}
+
+	return status
+}
+
+// fmtFile formats src, read from path, and reports whether that changed it.
+// with none of write, list and diff the result goes to standard output.
+func fmtFile(path string, src []byte, write, list, diff bool) (bool, error) {
+	out, err := formatSource(string(src))
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", path, err)
+	}
+
+	changed := out != string(src)
+
+	if list && changed {
+		fmt.Println(path)
+	}
+
+	if write && changed {
+		info, err := os.Stat(path)
+		if err != nil {
+			return changed, err
+		}
+		if err := os.WriteFile(path, []byte(out), info.Mode().Perm()); err != nil {
+			return changed, err
+		}
+	}
+
+	if diff && changed {
+		fmt.Print(unifiedDiff(path+".orig", path, string(src), out))
+	}
+
+	if !write && !list && !diff {
+		fmt.Print(out)
+	}
+
+	return changed, nil
+}
+
+// sourceFiles expands paths into the ayla files they name. directories are
+// searched recursively, skipping hidden ones.
+func sourceFiles(paths []string) ([]string, error) {
+	var files []string
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if p != path && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if isSourceFile(p) {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+func isSourceFile(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".ayla" || ext == ".ayl"
+}
@@ -0,0 +1,1170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/z-sk1/ayla-lang/parser"
+	"github.com/z-sk1/ayla-lang/token"
+)
+
+// indentUnit is one level of indentation in formatted code. there is a
+// single layout, so the client's formatting options are not consulted.
+const indentUnit = "    "
+
+type DocumentFormattingParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+}
+
+type DocumentRangeFormattingParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Range Range `json:"range"`
+}
+
+func (s *Server) handleFormatting(req *Request) {
+	var params DocumentFormattingParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	doc := s.document(params.TextDocument.URI)
+	if doc == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	f, err := formatDocument(doc.Text)
+	if err != nil {
+		log.Printf("format %s: %v", doc.URI, err)
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	edits := []TextEdit{}
+	if f.Text != doc.Text {
+		edits = append(edits, TextEdit{
+			Range:   Range{End: endPosition(doc.Text)},
+			NewText: f.Text,
+		})
+	}
+
+	s.sendResponse(req.ID, edits)
+}
+
+func (s *Server) handleRangeFormatting(req *Request) {
+	var params DocumentRangeFormattingParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	doc := s.document(params.TextDocument.URI)
+	if doc == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	f, err := formatDocument(doc.Text)
+	if err != nil {
+		log.Printf("format %s: %v", doc.URI, err)
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	s.sendResponse(req.ID, f.rangeEdits(doc.Text, params.Range))
+}
+
+// formatted is a document in the canonical layout, along with where each
+// top-level statement was and where it went.
+type formatted struct {
+	Text     string
+	segments []segment
+}
+
+// segment maps the source lines of a top-level statement, with the
+// comments sharing them, onto its formatted lines. both ends are inclusive.
+type segment struct {
+	srcStart, srcEnd int
+	outStart, outEnd int
+}
+
+// rangeEdits reformats the top-level statements touching r, each replacing
+// the whole lines it spans. the rest of the document is left alone.
+func (f *formatted) rangeEdits(text string, r Range) []TextEdit {
+	srcLines := strings.Split(text, "\n")
+	outLines := strings.Split(f.Text, "\n")
+
+	// a range ending at the start of a line does not take it in
+	last := r.End.Line
+	if r.End.Character == 0 && last > r.Start.Line {
+		last--
+	}
+
+	// statements sharing a line are replaced together
+	var merged []segment
+	for _, seg := range f.segments {
+		if n := len(merged); n > 0 && seg.srcStart <= merged[n-1].srcEnd {
+			merged[n-1].srcEnd = max(merged[n-1].srcEnd, seg.srcEnd)
+			merged[n-1].outEnd = max(merged[n-1].outEnd, seg.outEnd)
+			continue
+		}
+		merged = append(merged, seg)
+	}
+
+	edits := []TextEdit{}
+	for _, seg := range merged {
+		if seg.srcEnd < r.Start.Line || seg.srcStart > last || seg.srcEnd >= len(srcLines) {
+			continue
+		}
+
+		old := strings.Join(srcLines[seg.srcStart:seg.srcEnd+1], "\n")
+		formatted := strings.Join(outLines[seg.outStart:seg.outEnd+1], "\n")
+		if old == formatted {
+			continue
+		}
+
+		edits = append(edits, TextEdit{
+			Range: Range{
+				Start: Position{Line: seg.srcStart},
+				End:   Position{Line: seg.srcEnd, Character: utf16Len(srcLines[seg.srcEnd])},
+			},
+			NewText: formatted,
+		})
+	}
+
+	return edits
+}
+
+// formatSource returns text in the canonical layout.
+func formatSource(text string) (string, error) {
+	f, err := formatDocument(text)
+	if err != nil {
+		return "", err
+	}
+	return f.Text, nil
+}
+
+// formatDocument prints the tree of text back out in the canonical layout:
+// four space indents, one statement per line, spaces around binary
+// operators and after commas, '{' on the line that opens the block. single
+// blank lines between statements and every comment are kept.
+func formatDocument(text string) (f *formatted, err error) {
+	// the parser panics on some unbalanced parens
+	defer func() {
+		if r := recover(); r != nil {
+			f, err = nil, fmt.Errorf("cannot parse document: %v", r)
+		}
+	}()
+
+	program, toks, parseErrors := parseDocument(text)
+	if len(parseErrors) > 0 {
+		return nil, fmt.Errorf("cannot format a document with syntax errors: %v", parseErrors[0])
+	}
+
+	comments, strs := scanSource(text)
+
+	p := newPrinter(toks, comments, strs)
+	p.program(program)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	out := p.buf.String()
+
+	// only the layout may change. anything else would be a statement the
+	// parser dropped without an error, and is not the printer's to delete
+	if err := sameTokens(toks, lexTokens(out)); err != nil {
+		return nil, err
+	}
+	if _, _, errs := parseDocument(out); len(errs) > 0 {
+		return nil, fmt.Errorf("formatted document does not parse: %v", errs[0])
+	}
+
+	return &formatted{Text: out, segments: p.segments}, nil
+}
+
+// sameTokens checks that got holds the tokens of want, give or take
+// newlines, semicolons and the comma after the last field of a struct
+// literal.
+func sameTokens(want, got []token.Token) error {
+	want, got = significantTokens(want), significantTokens(got)
+
+	for i, tok := range want {
+		if i >= len(got) || got[i].Type != tok.Type || got[i].Literal != tok.Literal {
+			return fmt.Errorf("line %d: cannot format code the parser skips", tokenSpan(tok).Start.Line+1)
+		}
+	}
+	return nil
+}
+
+func significantTokens(toks []token.Token) []token.Token {
+	var out []token.Token
+	for i, tok := range toks {
+		switch tok.Type {
+		case token.NEWLINE, token.SEMICOLON:
+			continue
+		case token.COMMA:
+			if next := nextSignificant(toks, i); next < len(toks) && toks[next].Type == token.RBRACE {
+				continue
+			}
+		}
+		out = append(out, tok)
+	}
+	return out
+}
+
+// nextSignificant returns the index of the first token after i that is not
+// a newline, or len(toks).
+func nextSignificant(toks []token.Token, i int) int {
+	for i++; i < len(toks); i++ {
+		if toks[i].Type != token.NEWLINE {
+			return i
+		}
+	}
+	return len(toks)
+}
+
+// comment is a comment in the source. the lexer skips them, so they are
+// found by scanSource instead.
+type comment struct {
+	Text       string
+	Start, End Position
+}
+
+// scanSource finds the comments and the string literals in text, in order,
+// the same way the lexer does. strings are returned as written, quotes and
+// escapes included, since their tokens only hold the unescaped value.
+func scanSource(text string) ([]comment, []string) {
+	var comments []comment
+	var strs []string
+
+	line, lineStart := 0, 0
+	at := func(i int) Position {
+		return Position{Line: line, Character: utf16Len(text[lineStart:i])}
+	}
+
+	// skip moves past text[from:to], counting the lines in it
+	skip := func(from, to int) {
+		for i := from; i < to; i++ {
+			if text[i] == '\n' {
+				line++
+				lineStart = i + 1
+			}
+		}
+	}
+
+	for i := 0; i < len(text); {
+		switch {
+		case text[i] == '"':
+			// escaped quotes do not exist, the first quote ends the string
+			end := len(text)
+			if j := strings.IndexByte(text[i+1:], '"'); j >= 0 {
+				end = i + 1 + j + 1
+			}
+			strs = append(strs, text[i:end])
+			skip(i, end)
+			i = end
+
+		case strings.HasPrefix(text[i:], "//"):
+			end := len(text)
+			if j := strings.IndexByte(text[i:], '\n'); j >= 0 {
+				end = i + j
+			}
+			comments = append(comments, comment{
+				Text:  strings.TrimRight(text[i:end], " \t\r"),
+				Start: at(i),
+				End:   at(end),
+			})
+			i = end
+
+		case strings.HasPrefix(text[i:], "/*"):
+			end := len(text)
+			if j := strings.Index(text[i+2:], "*/"); j >= 0 {
+				end = i + 2 + j + 2
+			}
+			c := comment{Text: text[i:end], Start: at(i)}
+			skip(i, end)
+			c.End = at(end)
+			comments = append(comments, c)
+			i = end
+
+		default:
+			skip(i, i+1)
+			i++
+		}
+	}
+
+	return comments, strs
+}
+
+// printer writes a program out in the canonical layout. comments are
+// printed before the line whose first token follows them, or at the end of
+// the line they share with the last token of one.
+type printer struct {
+	*tokenIndex
+
+	buf     strings.Builder
+	indent  int
+	outLine int  // line of the output being written
+	bol     bool // nothing written on outLine yet, not even its indent
+
+	comments []comment
+	next     int // first comment not yet printed
+
+	// lastLine is the last source line printed in the current list of
+	// lines, or -1 at its start. a gap after it is kept as a blank line
+	lastLine int
+
+	// strs are the string literals as written, strAt finds the one behind
+	// a string token. interpolated strings have lost their token and take
+	// the next one after the last printed
+	strs    []string
+	strAt   map[token.Token]int
+	nextStr int
+
+	inDeclBlock bool // printing the decls of an egg or rock block
+	segments    []segment
+	err         error
+}
+
+func newPrinter(toks []token.Token, comments []comment, strs []string) *printer {
+	p := &printer{
+		tokenIndex: newTokenIndex(toks),
+		bol:        true,
+		comments:   comments,
+		lastLine:   -1,
+		strs:       strs,
+		strAt:      make(map[token.Token]int),
+	}
+
+	for _, tok := range toks {
+		if tok.Type == token.STRING {
+			p.strAt[tok] = len(p.strAt)
+		}
+	}
+	if len(p.strAt) != len(strs) {
+		p.err = fmt.Errorf("found %d strings in the source but the lexer found %d", len(strs), len(p.strAt))
+	}
+
+	return p
+}
+
+// fail records that n cannot be printed. only the first failure is kept.
+func (p *printer) fail(n parser.Node) {
+	if p.err != nil {
+		return
+	}
+
+	if isNilNode(n) {
+		p.err = fmt.Errorf("cannot format incomplete code")
+		return
+	}
+
+	kind := strings.TrimPrefix(fmt.Sprintf("%T", n), "*parser.")
+	if first, _ := p.tokenBounds(n); first >= 0 {
+		p.err = fmt.Errorf("line %d: cannot format %s", tokenSpan(p.toks[first]).Start.Line+1, kind)
+		return
+	}
+	p.err = fmt.Errorf("cannot format %s", kind)
+}
+
+func (p *printer) write(s string) {
+	if s == "" {
+		return
+	}
+	if p.bol {
+		p.buf.WriteString(strings.Repeat(indentUnit, p.indent))
+		p.bol = false
+	}
+	p.buf.WriteString(s)
+	p.outLine += strings.Count(s, "\n")
+}
+
+func (p *printer) newline() {
+	p.buf.WriteByte('\n')
+	p.outLine++
+	p.bol = true
+}
+
+// startLine moves to a fresh line unless already on one.
+func (p *printer) startLine() {
+	if !p.bol {
+		p.newline()
+	}
+}
+
+// leading prints the comments before pos on lines of their own.
+func (p *printer) leading(pos Position) {
+	for p.next < len(p.comments) && posBefore(p.comments[p.next].Start, pos) {
+		c := p.comments[p.next]
+		p.next++
+
+		p.startLine()
+		if p.lastLine >= 0 && c.Start.Line > p.lastLine+1 {
+			p.newline()
+		}
+		p.write(c.Text)
+		p.lastLine = c.End.Line
+	}
+}
+
+// trailing appends the comments starting on or before source line line to
+// the output line.
+func (p *printer) trailing(line int) {
+	for p.next < len(p.comments) && p.comments[p.next].Start.Line <= line {
+		c := p.comments[p.next]
+		p.next++
+
+		p.write(" " + c.Text)
+		p.lastLine = max(p.lastLine, c.End.Line)
+	}
+}
+
+// commentBefore reports whether a comment not yet printed starts before pos.
+func (p *printer) commentBefore(pos Position) bool {
+	return p.next < len(p.comments) && posBefore(p.comments[p.next].Start, pos)
+}
+
+// item prints one line of a list, which runs from token first to token
+// last in the source: the comments before it, a blank line if the source
+// had one, the line itself and the comments after it.
+func (p *printer) item(first, last int, print func()) {
+	start := tokenSpan(p.toks[first]).Start
+	p.leading(start)
+
+	p.startLine()
+	if p.lastLine >= 0 && start.Line > p.lastLine+1 {
+		p.newline()
+	}
+
+	print()
+
+	p.lastLine = tokenSpan(p.toks[last]).End.Line
+	p.trailing(p.lastLine)
+}
+
+// bracketed prints the bracket at open and its match around items, which
+// go on indented lines of their own. an empty pair stays on one line. it
+// returns the index of the closing bracket.
+func (p *printer) bracketed(open int, empty bool, items func()) int {
+	close := p.matching(open)
+	end := tokenSpan(p.toks[close]).Start
+
+	p.write(p.toks[open].Literal)
+
+	if !empty || p.commentBefore(end) {
+		// a comment right after the bracket stays on its line
+		line := tokenSpan(p.toks[open]).Start.Line
+		limit := end
+		if next := nextSignificant(p.toks, open); next < close {
+			limit = tokenSpan(p.toks[next]).Start
+		}
+		for p.next < len(p.comments) {
+			c := p.comments[p.next]
+			if c.Start.Line != line || !posBefore(c.Start, limit) {
+				break
+			}
+			p.next++
+			p.write(" " + c.Text)
+		}
+
+		saved := p.lastLine
+		p.lastLine = -1
+		p.indent++
+
+		items()
+		p.leading(end)
+
+		p.indent--
+		p.lastLine = saved
+		p.startLine()
+	}
+
+	if p.toks[open].Type == token.LPAREN {
+		p.write(")")
+	} else {
+		p.write("}")
+	}
+
+	return close
+}
+
+// block prints a block of statements opened by the '{' at open. a block
+// that must span lines is never collapsed to '{}'.
+func (p *printer) block(list []parser.Statement, open int, multiline bool) int {
+	if open < 0 || p.toks[open].Type != token.LBRACE {
+		p.fail(nil)
+		return -1
+	}
+
+	return p.bracketed(open, len(list) == 0 && !multiline, func() {
+		p.stmts(list)
+	})
+}
+
+func (p *printer) stmts(list []parser.Statement) {
+	for _, stmt := range list {
+		first, last := p.stmtBounds(stmt)
+		if first < 0 {
+			p.fail(stmt)
+			return
+		}
+		p.item(first, last, func() { p.stmt(stmt) })
+	}
+}
+
+func (p *printer) program(program []parser.Statement) {
+	for _, stmt := range program {
+		first, last := p.stmtBounds(stmt)
+		if first < 0 {
+			p.fail(stmt)
+			return
+		}
+
+		// the segment starts with whatever shares the statement's first
+		// line, which item prints after any blank line
+		start := tokenSpan(p.toks[first]).Start
+		p.leading(Position{Line: start.Line})
+
+		seg := segment{srcStart: start.Line, outStart: p.outLine}
+		if !p.bol {
+			seg.outStart++
+		}
+		if p.lastLine >= 0 && start.Line > p.lastLine+1 {
+			seg.outStart++
+		}
+
+		p.item(first, last, func() { p.stmt(stmt) })
+
+		seg.srcEnd, seg.outEnd = p.lastLine, p.outLine
+		p.segments = append(p.segments, seg)
+	}
+
+	p.leading(Position{Line: math.MaxInt32})
+	p.startLine()
+}
+
+// at returns the index of tok, or -1 after recording a failure.
+func (p *printer) at(tok token.Token) int {
+	i, ok := p.index[tok]
+	if !ok {
+		p.fail(nil)
+		return -1
+	}
+	return i
+}
+
+// nextTok returns the index of the first token of type typ after i, or -1.
+func (p *printer) nextTok(i int, typ token.TokenType) int {
+	if i < 0 {
+		return -1
+	}
+	for i++; i < len(p.toks); i++ {
+		if p.toks[i].Type == typ {
+			return i
+		}
+	}
+	return -1
+}
+
+// headerEnd returns the index of the last token of a header from the
+// keyword at kw through n, which may be nil.
+func (p *printer) headerEnd(kw int, n parser.Node) int {
+	first, last := p.tokenBounds(n)
+	if first < 0 {
+		return kw
+	}
+	return max(kw, p.closeBrackets(first, last))
+}
+
+// blockAfter prints the block opened by the first '{' after the header
+// from kw through n.
+func (p *printer) blockAfter(list []parser.Statement, kw int, n parser.Node, multiline bool) int {
+	return p.block(list, p.nextTok(p.headerEnd(kw, n), token.LBRACE), multiline)
+}
+
+func (p *printer) stmt(stmt parser.Statement) {
+	switch s := stmt.(type) {
+	case *parser.VarStatement:
+		p.decl("egg", []*parser.Identifier{s.Name}, s.Type, s.Value)
+
+	case *parser.MultiVarStatement:
+		p.decl("egg", s.Names, s.Type, s.Value)
+
+	case *parser.ConstStatement:
+		p.decl("rock", []*parser.Identifier{s.Name}, s.Type, s.Value)
+
+	case *parser.MultiConstStatement:
+		p.decl("rock", s.Names, s.Type, s.Value)
+
+	case *parser.VarStatementBlock:
+		p.declBlock("egg", s.Token, s.Decls)
+
+	case *parser.ConstStatementBlock:
+		p.declBlock("rock", s.Token, s.Decls)
+
+	case *parser.VarStatementNoKeyword:
+		p.write(s.Name.Value + " := ")
+		p.expr(s.Value)
+
+	case *parser.MultiVarStatementNoKeyword:
+		p.write(identList(s.Names) + " := ")
+		p.expr(s.Value)
+
+	case *parser.AssignmentStatement:
+		p.write(s.Name.Value + " = ")
+		p.expr(s.Value)
+
+	case *parser.MultiAssignmentStatement:
+		p.write(identList(s.Names) + " = ")
+		p.expr(s.Value)
+
+	case *parser.IndexAssignmentStatement:
+		p.expr(s.Left)
+		p.write("[")
+		p.expr(s.Index)
+		p.write("]")
+		if !isNilNode(s.Value) {
+			p.write(" = ")
+			p.expr(s.Value)
+		}
+
+	case *parser.MemberAssignmentStatement:
+		p.expr(s.Object)
+		p.write("." + s.Field.Value + " = ")
+		p.expr(s.Value)
+
+	case *parser.ExpressionStatement:
+		p.expr(s.Expression)
+
+	case *parser.TypeStatement:
+		p.write("type " + s.Name.Value + " ")
+		if s.Alias {
+			p.write("= ")
+		}
+		p.typ(s.Type)
+
+	case *parser.EnumStatement:
+		p.enum(s)
+
+	case *parser.FuncStatement:
+		p.funcStmt(s)
+
+	case *parser.ReturnStatement:
+		p.write("back")
+		// a bare back followed by a newline parses as a nil value
+		var values []parser.Expression
+		for _, value := range s.Values {
+			if !isNilNode(value) {
+				values = append(values, value)
+			}
+		}
+		if len(values) > 0 {
+			p.write(" ")
+			p.exprList(values)
+		}
+
+	case *parser.BreakStatement:
+		p.write("kitkat")
+
+	case *parser.ContinueStatement:
+		p.write("next")
+
+	case *parser.IfStatement:
+		p.ifStmt(s)
+
+	case *parser.ForStatement:
+		p.forStmt(s)
+
+	case *parser.ForRangeStatement:
+		p.write("four ")
+		if s.Key != nil {
+			p.write(s.Key.Value)
+			if s.Value != nil {
+				p.write(", " + s.Value.Value)
+			}
+			p.write(" := ")
+		}
+		p.write("range ")
+		p.expr(s.Expr)
+		p.write(" ")
+		p.blockAfter(s.Body, p.at(s.Token), s.Expr, false)
+
+	case *parser.WhileStatement:
+		p.write("why ")
+		p.expr(s.Condition)
+		p.write(" ")
+		p.blockAfter(s.Body, p.at(s.Token), s.Condition, false)
+
+	case *parser.SpawnStatement:
+		p.write("spawn ")
+		p.blockAfter(s.Body, p.at(s.Token), nil, false)
+
+	case *parser.WithStatement:
+		// the parser skips the token after the '{', which has to be a
+		// newline
+		p.write("with ")
+		p.expr(s.Expr)
+		p.write(" ")
+		p.blockAfter(s.Body, p.at(s.Token), s.Expr, true)
+
+	case *parser.SwitchStatement:
+		p.switchStmt(s)
+
+	default:
+		p.fail(stmt)
+	}
+}
+
+// decl prints a declaration, leaving out the keyword inside a decl block.
+func (p *printer) decl(keyword string, names []*parser.Identifier, typ parser.TypeNode, value parser.Expression) {
+	if !p.inDeclBlock {
+		p.write(keyword + " ")
+	}
+	p.write(identList(names))
+
+	if !isNilNode(typ) {
+		p.write(" ")
+		p.typ(typ)
+	}
+	if !isNilNode(value) {
+		p.write(" = ")
+		p.expr(value)
+	}
+}
+
+func (p *printer) declBlock(keyword string, tok token.Token, decls []parser.Statement) {
+	open := p.nextTok(p.at(tok), token.LPAREN)
+	if open < 0 {
+		p.fail(nil)
+		return
+	}
+
+	p.write(keyword + " ")
+	p.bracketed(open, len(decls) == 0, func() {
+		p.inDeclBlock = true
+		p.stmts(decls)
+		p.inDeclBlock = false
+	})
+}
+
+func (p *printer) enum(s *parser.EnumStatement) {
+	open := p.nextTok(p.at(s.Name.Token), token.LBRACE)
+	if open < 0 {
+		p.fail(s)
+		return
+	}
+
+	p.write("enum " + s.Name.Value + " ")
+	p.bracketed(open, len(s.Variants) == 0, func() {
+		for _, variant := range s.Variants {
+			i := p.at(variant.Token)
+			if i < 0 {
+				return
+			}
+			p.item(i, i, func() { p.write(variant.Value) })
+		}
+	})
+}
+
+func (p *printer) funcStmt(s *parser.FuncStatement) {
+	p.write("fun " + s.Name.Value + "(")
+	for i, param := range s.Params {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.write(param.Name.Value)
+		if !isNilNode(param.Type) {
+			p.write(" ")
+			p.typ(param.Type)
+		}
+	}
+	p.write(")")
+
+	if len(s.ReturnTypes) > 0 {
+		p.write(" (" + identList(s.ReturnTypes) + ")")
+	}
+
+	p.write(" ")
+	p.block(s.Body, p.nextTok(p.at(s.Name.Token), token.LBRACE), false)
+}
+
+func (p *printer) ifStmt(s *parser.IfStatement) {
+	p.write("ayla ")
+	p.expr(s.Condition)
+	p.write(" ")
+
+	close := p.blockAfter(s.Consequence, p.at(s.Token), s.Condition, false)
+	if close < 0 {
+		return
+	}
+
+	// the alternative is only known to be there by its elen
+	els := nextSignificant(p.toks, close)
+	if els >= len(p.toks) || p.toks[els].Type != token.ELSE {
+		return
+	}
+	p.write(" elen ")
+
+	next := nextSignificant(p.toks, els)
+	if next < len(p.toks) && p.toks[next].Type == token.IF {
+		if len(s.Alternative) == 1 {
+			if alt, ok := s.Alternative[0].(*parser.IfStatement); ok && !isNilNode(alt) {
+				p.ifStmt(alt)
+				return
+			}
+		}
+		p.fail(s)
+		return
+	}
+
+	p.block(s.Alternative, p.nextTok(els, token.LBRACE), false)
+}
+
+func (p *printer) forStmt(s *parser.ForStatement) {
+	if isNilNode(s.Condition) || isNilNode(s.Post) {
+		p.fail(s)
+		return
+	}
+
+	p.write("four ")
+
+	// the parser skips the token after four, which is where egg goes, and
+	// keeps it as the loop's token
+	kw := p.at(s.Token)
+	if first, _ := p.tokenBounds(s.Init); first > kw {
+		p.write(s.Token.Literal + " ")
+	}
+
+	if isNilNode(s.Init) {
+		// an init with a type, such as egg i int, is not kept in the tree,
+		// only its tokens are left
+		semi := p.nextTok(kw, token.SEMICOLON)
+		if semi < 0 {
+			p.fail(s)
+			return
+		}
+		var words []string
+		for _, tok := range p.toks[kw:semi] {
+			words = append(words, tok.Literal)
+		}
+		p.write(strings.Join(words, " "))
+	} else {
+		p.stmt(s.Init)
+	}
+	p.write("; ")
+	p.expr(s.Condition)
+	p.write("; ")
+	p.stmt(s.Post)
+	p.write(" ")
+
+	p.blockAfter(s.Body, p.at(s.Token), s.Post, false)
+}
+
+// switchStmt prints a decide statement. the parser wants each when and
+// otherwise right after the '{' or '}' before it, with no newline between,
+// so this is the one layout of it that parses.
+func (p *printer) switchStmt(s *parser.SwitchStatement) {
+	p.write("decide ")
+	p.expr(s.Value)
+	p.write(" {")
+
+	sep := ""
+	for _, c := range s.Cases {
+		if c == nil {
+			continue
+		}
+		p.write(sep + "when ")
+		p.expr(c.Expr)
+		p.write(" ")
+		p.blockAfter(c.Body, p.at(c.Token), c.Expr, false)
+		sep = " "
+	}
+
+	if s.Default != nil {
+		p.write(sep + "otherwise ")
+		p.blockAfter(s.Default.Body, p.at(s.Default.Token), nil, false)
+	}
+
+	p.write("}")
+}
+
+func (p *printer) typ(t parser.TypeNode) {
+	switch t := t.(type) {
+	case *parser.IdentType:
+		p.write(t.Name)
+
+	case *parser.ArrayType:
+		p.write("[]")
+		p.typ(t.Elem)
+
+	case *parser.MapType:
+		p.write("map[")
+		p.typ(t.Key)
+		p.write("]")
+		p.typ(t.Value)
+
+	case *parser.StructType:
+		p.structType(t)
+
+	default:
+		p.fail(t)
+	}
+}
+
+func (p *printer) structType(t *parser.StructType) {
+	// the struct type's token is its '}'
+	close := p.at(t.Token)
+	if close < 0 || p.toks[close].Type != token.RBRACE {
+		p.fail(t)
+		return
+	}
+
+	open := close
+	for depth := 0; open >= 0; open-- {
+		depth -= bracketDelta(p.toks[open])
+		if depth == 0 {
+			break
+		}
+	}
+	if open < 0 {
+		p.fail(t)
+		return
+	}
+
+	p.write("struct ")
+	p.bracketed(open, len(t.Fields) == 0, func() {
+		for _, field := range t.Fields {
+			if field == nil || field.Name == nil {
+				continue
+			}
+
+			first := p.at(field.Name.Token)
+			if first < 0 {
+				return
+			}
+			last := first
+			if base := nodeBase(field.Type); base != nil {
+				if i, ok := p.index[base.Token]; ok {
+					last = i
+				}
+			}
+
+			p.item(first, last, func() {
+				p.write(field.Name.Value + " ")
+				p.typ(field.Type)
+			})
+		}
+	})
+}
+
+func (p *printer) expr(e parser.Expression) {
+	switch e := e.(type) {
+	case *parser.Identifier:
+		p.write(e.Value)
+
+	case *parser.IntLiteral:
+		p.write(e.Token.Literal)
+
+	case *parser.FloatLiteral:
+		p.write(e.Token.Literal)
+
+	case *parser.BoolLiteral:
+		p.write(e.Token.Literal)
+
+	case *parser.NilLiteral:
+		p.write("nil")
+
+	case *parser.StringLiteral:
+		i, ok := p.strAt[e.Token]
+		if !ok {
+			p.fail(e)
+			return
+		}
+		p.write(p.strs[i])
+		p.nextStr = i + 1
+
+	case *parser.InterpolatedString:
+		if p.nextStr >= len(p.strs) {
+			p.fail(e)
+			return
+		}
+		p.write(p.strs[p.nextStr])
+		p.nextStr++
+
+	case *parser.PrefixExpression:
+		p.write(e.Operator)
+		p.expr(e.Right)
+
+	case *parser.InfixExpression:
+		p.expr(e.Left)
+		p.write(" " + e.Operator + " ")
+		p.expr(e.Right)
+
+	case *parser.InExpression:
+		p.expr(e.Left)
+		p.write(" in ")
+		p.expr(e.Right)
+
+	case *parser.GroupedExpression:
+		p.write("(")
+		p.expr(e.Expression)
+		p.write(")")
+
+	case *parser.FuncCall:
+		p.write(e.Name.Value + "(")
+		p.exprList(e.Args)
+		p.write(")")
+
+	case *parser.IndexExpression:
+		p.expr(e.Left)
+		p.write("[")
+		p.expr(e.Index)
+		p.write("]")
+
+	case *parser.MemberExpression:
+		p.expr(e.Left)
+		p.write("." + e.Field.Value)
+
+	case *parser.TypeAssertExpression:
+		p.expr(e.Expr)
+		p.write(".(")
+		p.typ(e.Type)
+		p.write(")")
+
+	case *parser.ArrayLiteral:
+		p.write("[")
+		p.exprList(e.Elements)
+		p.write("]")
+
+	case *parser.MapLiteral:
+		p.write("{")
+		for i, pair := range e.Pairs {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.expr(pair.Key)
+			p.write(": ")
+			p.expr(pair.Value)
+		}
+		p.write("}")
+
+	case *parser.TupleLiteral:
+		p.exprList(e.Values)
+
+	case *parser.StructLiteral:
+		p.write(e.TypeName.Value)
+		p.structLiteral(e, e.Token, e.Fields)
+
+	case *parser.AnonymousStructLiteral:
+		p.write("struct")
+		p.structLiteral(e, e.Token, e.Fields)
+
+	default:
+		p.fail(e)
+	}
+}
+
+func (p *printer) exprList(list []parser.Expression) {
+	for i, e := range list {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.expr(e)
+	}
+}
+
+// structLiteral prints the fields of a struct literal whose '{' follows
+// tok. the fields are a map, their order comes from the source. a literal
+// spanning lines keeps one field per line.
+func (p *printer) structLiteral(lit parser.Expression, tok token.Token, fields map[string]parser.Expression) {
+	open := p.at(tok) + 1
+	if open <= 0 || open >= len(p.toks) || p.toks[open].Type != token.LBRACE {
+		p.fail(lit)
+		return
+	}
+	close := p.matching(open)
+
+	var keys []int
+	depth := 0
+	for i := open; i <= close; i++ {
+		depth += bracketDelta(p.toks[i])
+		if depth == 1 && p.toks[i].Type == token.IDENT && i+1 < len(p.toks) && p.toks[i+1].Type == token.COLON {
+			keys = append(keys, i)
+		}
+	}
+
+	if len(keys) != len(fields) {
+		p.fail(lit)
+		return
+	}
+	for _, key := range keys {
+		if _, ok := fields[p.toks[key].Literal]; !ok {
+			p.fail(lit)
+			return
+		}
+	}
+
+	if len(keys) == 0 || p.toks[open].Line == p.toks[close].Line {
+		p.write("{")
+		for i, key := range keys {
+			if i > 0 {
+				p.write(", ")
+			}
+			name := p.toks[key].Literal
+			p.write(name + ": ")
+			p.expr(fields[name])
+		}
+		p.write("}")
+		return
+	}
+
+	p.bracketed(open, false, func() {
+		for _, key := range keys {
+			name := p.toks[key].Literal
+			p.item(key, p.fieldEnd(key), func() {
+				p.write(name + ": ")
+				p.expr(fields[name])
+				p.write(",")
+			})
+		}
+	})
+}
+
+// fieldEnd returns the index of the ',' after the struct literal field
+// whose key is at key, or of its last token when no ',' follows.
+func (p *printer) fieldEnd(key int) int {
+	depth := 0
+	last := key
+	for i := key + 1; i < len(p.toks); i++ {
+		tok := p.toks[i]
+		if tok.Type == token.NEWLINE {
+			continue
+		}
+
+		delta := bracketDelta(tok)
+		if depth+delta < 0 || tok.Type == token.EOF {
+			break
+		}
+		depth += delta
+		last = i
+
+		if depth == 0 && tok.Type == token.COMMA {
+			break
+		}
+	}
+	return last
+}
+
+func identList(idents []*parser.Identifier) string {
+	names := make([]string, len(idents))
+	for i, ident := range idents {
+		names[i] = ident.Value
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatSource(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "layout",
+			src:  "egg x=1\nfun f(a,b){\nback a+b\n}\n",
+			want: "egg x = 1\nfun f(a, b) {\n    back a + b\n}\n",
+		},
+		{
+			name: "line comments",
+			src:  "// top\negg x=1 // trailing\nexplodeln(x)   // after a call\n",
+			want: "// top\negg x = 1 // trailing\nexplodeln(x) // after a call\n",
+		},
+		{
+			name: "block comments",
+			src:  "/* block\n   comment */\nfun f(a,b){\nback a+b /* inline */\n}\n",
+			want: "/* block\n   comment */\nfun f(a, b) {\n    back a + b /* inline */\n}\n",
+		},
+		{
+			name: "comments in a block",
+			src:  "fun h() {\n  // first\n  back 1 // e\n}\n",
+			want: "fun h() {\n    // first\n    back 1 // e\n}\n",
+		},
+		{
+			name: "multi-line string",
+			src:  "egg s=\"one\ntwo\"\nexplodeln(s)\n",
+			want: "egg s = \"one\ntwo\"\nexplodeln(s)\n",
+		},
+		{
+			name: "escaped string",
+			src:  "egg t  =  \"a\\tb \\\\ \\n\"\nexplodeln(t)\n",
+			want: "egg t = \"a\\tb \\\\ \\n\"\nexplodeln(t)\n",
+		},
+		{
+			name: "non-ascii string",
+			src:  "explodeln(\"héllo 😀\",1)\n",
+			want: "explodeln(\"héllo 😀\", 1)\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := formatSource(tt.src)
+			if err != nil {
+				t.Fatalf("formatSource: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("formatSource(%q)\n got %q\nwant %q", tt.src, got, tt.want)
+			}
+
+			again, err := formatSource(got)
+			if err != nil {
+				t.Fatalf("formatSource of the result: %v", err)
+			}
+			if again != got {
+				t.Errorf("formatting again changed the result\n got %q\nwant %q", again, got)
+			}
+		})
+	}
+}
+
+// TestFormatExamples formats the examples shipped with the ayla module and
+// checks a second run changes nothing.
+func TestFormatExamples(t *testing.T) {
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "github.com/z-sk1/ayla-lang").Output()
+	if err != nil {
+		t.Skipf("cannot find the ayla module: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(strings.TrimSpace(string(out)), "examples", "*.ayl*"))
+	if len(files) == 0 {
+		t.Skip("the ayla module has no examples")
+	}
+
+	for _, path := range files {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			src, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a few examples use syntax this version of the parser rejects
+			if _, _, errs := parseDocument(string(src)); len(errs) > 0 {
+				t.Skipf("does not parse: %v", errs[0])
+			}
+
+			once, err := formatSource(string(src))
+			if err != nil {
+				t.Fatalf("formatSource: %v", err)
+			}
+			twice, err := formatSource(once)
+			if err != nil {
+				t.Fatalf("formatSource of the result: %v", err)
+			}
+			if twice != once {
+				t.Errorf("formatting again changed the result\n got %q\nwant %q", twice, once)
+			}
+		})
+	}
+}
+
+func TestRangeEdits(t *testing.T) {
+	src := "egg a=1\negg b=2\nfun f(x){\nback x+1\n}\negg c=3\n"
+
+	tests := []struct {
+		name string
+		r    Range
+		want []TextEdit
+	}{
+		{
+			name: "one line",
+			r:    Range{Start: Position{Line: 1}, End: Position{Line: 1, Character: 3}},
+			want: []TextEdit{
+				{Range: Range{Start: Position{Line: 1}, End: Position{Line: 1, Character: 7}}, NewText: "egg b = 2"},
+			},
+		},
+		{
+			name: "inside a function",
+			r:    Range{Start: Position{Line: 3, Character: 2}, End: Position{Line: 3, Character: 4}},
+			want: []TextEdit{
+				{Range: Range{Start: Position{Line: 2}, End: Position{Line: 4, Character: 1}}, NewText: "fun f(x) {\n    back x + 1\n}"},
+			},
+		},
+		{
+			name: "ending at the start of a line",
+			r:    Range{Start: Position{Line: 0}, End: Position{Line: 2}},
+			want: []TextEdit{
+				{Range: Range{Start: Position{Line: 0}, End: Position{Line: 0, Character: 7}}, NewText: "egg a = 1"},
+				{Range: Range{Start: Position{Line: 1}, End: Position{Line: 1, Character: 7}}, NewText: "egg b = 2"},
+			},
+		},
+	}
+
+	f, err := formatDocument(src)
+	if err != nil {
+		t.Fatalf("formatDocument: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := f.rangeEdits(src, tt.r)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d edits %+v, want %d", len(got), got, len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("edit %d: got %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// commands are the subcommands run instead of the server.
+var commands = map[string]func(args []string) int{
+	"fmt":   runFmt,
+	"check": runCheck,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			// the analysis logs for the server's log file, not the terminal
+			log.SetOutput(io.Discard)
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
+	stdio := flag.Bool("stdio", false, "serve a single client over stdin and stdout (the default)")
+	tcpAddr := flag.String("tcp", "", "serve clients connecting to this TCP `address`, such as :7777")
+	socketPath := flag.String("socket", "", "serve clients connecting to the Unix domain socket at `path`")
+	flag.Parse()
+
+	f, err := os.Create("ayla-lsp.log")
+	if err == nil {
+		log.SetOutput(f)
+	}
+
+	switch {
+	case *tcpAddr != "" && *socketPath != "",
+		*stdio && (*tcpAddr != "" || *socketPath != ""):
+		fmt.Fprintln(os.Stderr, "elen: use only one of --stdio, --tcp and --socket")
+		os.Exit(2)
+
+	case *tcpAddr != "":
+		listen("tcp", *tcpAddr)
+
+	case *socketPath != "":
+		listen("unix", *socketPath)
+
+	default:
+		server := NewServer(os.Stdin, os.Stdout)
+		os.Exit(server.Run())
+	}
+}
+
+// listen serves every client that connects to address, each with a server
+// of its own, until the process is interrupted.
+func listen(network, address string) {
+	if network == "unix" {
+		removeStaleSocket(address)
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "elen: %v\n", err)
+		os.Exit(1)
+	}
+
+	// closing the listener also removes a unix socket file
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		l.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "elen: listening on %s %s\n", network, l.Addr())
+	log.Printf("listening on %s %s", network, l.Addr())
+
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("accept: %v", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+
+			log.Printf("client %s connected", conn.RemoteAddr())
+			code := NewServer(conn, conn).Run()
+			log.Printf("client %s disconnected (exit code %d)", conn.RemoteAddr(), code)
+		}()
+	}
+}
+
+// removeStaleSocket removes a socket file left behind by an instance that
+// did not shut down cleanly. a socket someone still listens on is kept.
+func removeStaleSocket(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
+
+	os.Remove(path)
+}
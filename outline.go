@@ -0,0 +1,239 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/z-sk1/ayla-lang/parser"
+	"github.com/z-sk1/ayla-lang/token"
+)
+
+type DocumentSymbolParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+}
+
+type DocumentSymbol struct {
+	Name           string           `json:"name"`
+	Detail         string           `json:"detail,omitempty"`
+	Kind           int              `json:"kind"`
+	Range          Range            `json:"range"`
+	SelectionRange Range            `json:"selectionRange"`
+	Children       []DocumentSymbol `json:"children,omitempty"`
+}
+
+// SymbolKind values from the LSP spec
+const (
+	SymbolKindClass      = 5
+	SymbolKindField      = 8
+	SymbolKindEnum       = 10
+	SymbolKindFunction   = 12
+	SymbolKindVariable   = 13
+	SymbolKindConstant   = 14
+	SymbolKindEnumMember = 22
+	SymbolKindStruct     = 23
+)
+
+func (s *Server) handleDocumentSymbol(req *Request) {
+	var params DocumentSymbolParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	a := s.analysis(params.TextDocument.URI)
+	if a == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	var syms []*Symbol
+	for _, sym := range a.Root.Symbols {
+		syms = append(syms, sym)
+	}
+
+	o := newOutliner(a.Tokens)
+
+	symbols := o.symbols(syms)
+	if symbols == nil {
+		symbols = []DocumentSymbol{}
+	}
+
+	s.sendResponse(req.ID, symbols)
+}
+
+type outliner struct {
+	toks []token.Token
+
+	// index finds a token in toks, tokens are unique by position
+	index map[token.Token]int
+}
+
+func newOutliner(toks []token.Token) *outliner {
+	index := make(map[token.Token]int, len(toks))
+	for i, tok := range toks {
+		index[tok] = i
+	}
+	return &outliner{toks: toks, index: index}
+}
+
+// symbols turns the declared symbols of a scope into document symbols in
+// source order.
+func (o *outliner) symbols(syms []*Symbol) []DocumentSymbol {
+	var decls []*Symbol
+	for _, sym := range syms {
+		// implicit symbols such as 'it' have nothing to point at
+		if sym.Ident != nil {
+			decls = append(decls, sym)
+		}
+	}
+
+	sort.Slice(decls, func(i, j int) bool {
+		return posBefore(identRange(decls[i].Ident).Start, identRange(decls[j].Ident).Start)
+	})
+
+	var out []DocumentSymbol
+	for _, sym := range decls {
+		out = append(out, o.symbol(sym))
+	}
+	return out
+}
+
+func (o *outliner) symbol(sym *Symbol) DocumentSymbol {
+	ds := DocumentSymbol{
+		Name:           sym.Name,
+		Range:          o.declRange(sym.Ident, sym.Decl),
+		SelectionRange: identRange(sym.Ident),
+	}
+
+	if t := symbolType(sym); t != nil && sym.Kind != SymFunc && sym.Kind != SymUserType {
+		ds.Detail = typeNodeToString(t)
+	}
+
+	switch sym.Kind {
+	case SymVar, SymParam:
+		ds.Kind = SymbolKindVariable
+
+	case SymConst:
+		ds.Kind = SymbolKindConstant
+
+	case SymFunc:
+		ds.Kind = SymbolKindFunction
+		if fnScope := ownedScope(sym); fnScope != nil {
+			ds.Children = o.symbols(blockSymbols(fnScope))
+		}
+
+	case SymStructField:
+		ds.Kind = SymbolKindField
+
+	case SymUserType:
+		// a named type over another type, structs and enums are told
+		// apart below
+		ds.Kind = SymbolKindClass
+
+		switch t := sym.Type.(type) {
+		case *parser.StructType:
+			ds.Kind = SymbolKindStruct
+			for _, field := range t.Fields {
+				if field == nil || field.Name == nil {
+					continue
+				}
+				ds.Children = append(ds.Children, DocumentSymbol{
+					Name:           field.Name.Value,
+					Detail:         typeNodeToString(field.Type),
+					Kind:           SymbolKindField,
+					Range:          o.declRange(field.Name, nil),
+					SelectionRange: identRange(field.Name),
+				})
+			}
+
+		case *parser.IdentType:
+			ds.Detail = t.Name
+		}
+
+		if enum, ok := sym.Decl.(*parser.EnumStatement); ok {
+			ds.Kind = SymbolKindEnum
+			ds.Detail = ""
+			for _, variant := range enum.Variants {
+				if variant == nil {
+					continue
+				}
+				ds.Children = append(ds.Children, DocumentSymbol{
+					Name:           variant.Value,
+					Kind:           SymbolKindEnumMember,
+					Range:          identRange(variant),
+					SelectionRange: identRange(variant),
+				})
+			}
+		}
+	}
+
+	return ds
+}
+
+// ownedScope returns the scope holding the params and body of function fn.
+func ownedScope(fn *Symbol) *Scope {
+	for _, child := range fn.Scope.Children {
+		if child.Owner == fn {
+			return child
+		}
+	}
+	return nil
+}
+
+// blockSymbols collects the symbols of scope and of the blocks nested in
+// it, leaving out the bodies of nested functions, which outline on their
+// own.
+func blockSymbols(scope *Scope) []*Symbol {
+	var syms []*Symbol
+	for _, sym := range scope.Symbols {
+		syms = append(syms, sym)
+	}
+
+	for _, child := range scope.Children {
+		if child.Owner == nil {
+			syms = append(syms, blockSymbols(child)...)
+		}
+	}
+
+	return syms
+}
+
+// declRange spans a declaration from its keyword, when decl is given, to
+// the end of the statement: the first newline or ';' outside any brackets,
+// or the ',' or ')' closing a param.
+func (o *outliner) declRange(ident *parser.Identifier, decl parser.Node) Range {
+	r := identRange(ident)
+
+	if base := nodeBase(decl); base != nil {
+		if start := tokenSpan(base.Token).Start; posBefore(start, r.Start) {
+			r.Start = start
+		}
+	}
+
+	i, ok := o.index[ident.Token]
+	if !ok {
+		return r
+	}
+
+	depth := 0
+	for _, tok := range o.toks[i+1:] {
+		switch tok.Type {
+		case token.LPAREN, token.LBRACKET, token.LBRACE:
+			depth++
+		case token.RPAREN, token.RBRACKET, token.RBRACE:
+			depth--
+		}
+
+		if tok.Type == token.EOF || depth < 0 {
+			break
+		}
+		if depth == 0 && (tok.Type == token.NEWLINE || tok.Type == token.SEMICOLON || tok.Type == token.COMMA) {
+			break
+		}
+		if tok.Type != token.NEWLINE {
+			r.End = tokenSpan(tok).End
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/z-sk1/ayla-lang/lexer"
+	"github.com/z-sk1/ayla-lang/parser"
+	"github.com/z-sk1/ayla-lang/token"
+)
+
+// lexTokens returns every token in text, ending with the EOF token, rebased
+// for tokenSpan.
+func lexTokens(text string) []token.Token {
+	toks := lexRaw(text)
+
+	src := newSourceText(text)
+	for i := range toks {
+		toks[i] = src.rebase(toks[i])
+	}
+	return toks
+}
+
+// lexRaw returns the tokens of text as the lexer reports them.
+func lexRaw(text string) []token.Token {
+	l := lexer.New(text)
+
+	var toks []token.Token
+	for {
+		tok := l.NextToken()
+		toks = append(toks, tok)
+		if tok.Type == token.EOF {
+			return toks
+		}
+	}
+}
+
+// sourceText maps the lexer's positions back into the text it lexed.
+type sourceText struct {
+	text       string
+	lineStarts []int
+}
+
+func newSourceText(text string) *sourceText {
+	s := &sourceText{text: text, lineStarts: []int{0}}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			s.lineStarts = append(s.lineStarts, i+1)
+		}
+	}
+	return s
+}
+
+// offset returns the byte offset of byte column col of line, both 0-based,
+// clamped to the line.
+func (s *sourceText) offset(line, col int) int {
+	line = min(max(line, 0), len(s.lineStarts)-1)
+
+	end := len(s.text)
+	if line+1 < len(s.lineStarts) {
+		end = s.lineStarts[line+1] - 1
+	}
+	return min(s.lineStarts[line]+max(col, 0), end)
+}
+
+// position converts a byte offset to an lsp position.
+func (s *sourceText) position(offset int) Position {
+	line := sort.Search(len(s.lineStarts), func(i int) bool {
+		return s.lineStarts[i] > offset
+	}) - 1
+	return Position{Line: line, Character: utf16Len(s.text[s.lineStarts[line]:offset])}
+}
+
+// end returns the byte offset just past tok, a word or string token as the
+// lexer reports it. the lexer has already read the character after such a
+// token, and it bumps its line as soon as it reads a '\n', so a token that
+// ends a line is reported at column 0 of the next one.
+func (s *sourceText) end(tok token.Token) int {
+	line := tok.Line - 1
+	if tok.Column == 0 && line > 0 && line < len(s.lineStarts) {
+		return s.lineStarts[line] - 1
+	}
+	return s.offset(line, tok.Column-1)
+}
+
+// rebase moves tok from the lexer's columns, which count bytes and point at
+// or just past its end, to the utf-16 column of its first character, counted
+// from 1. a string token also gets its source text, quotes and escapes
+// included, as its literal, so tokenSpan can size it even across lines.
+func (s *sourceText) rebase(tok token.Token) token.Token {
+	if tok.Line <= 0 {
+		return tok
+	}
+	line := tok.Line - 1
+
+	var start int
+	switch {
+	case tok.Type == token.NEWLINE:
+		// the lexer puts a line end on the line after it
+		if line == 0 || line >= len(s.lineStarts) {
+			return tok
+		}
+		start = s.lineStarts[line] - 1
+
+	case tok.Type == token.EOF:
+		start = s.offset(line, tok.Column-1)
+
+	case tok.Type == token.STRING:
+		// the first quote ends a string, and an unterminated one runs to
+		// the end of the text
+		end := s.end(tok)
+		start = -1
+		if end > 0 && s.text[end-1] == '"' {
+			start = strings.LastIndexByte(s.text[:end-1], '"')
+		}
+		if start < 0 {
+			start = strings.LastIndexByte(s.text[:end], '"')
+		}
+		if start < 0 {
+			return tok
+		}
+		tok.Literal = s.text[start:end]
+
+	case isWordTok(tok):
+		start = max(s.end(tok)-len(tok.Literal), 0)
+
+	default:
+		start = s.offset(line, tok.Column-len(tok.Literal))
+	}
+
+	pos := s.position(start)
+	tok.Line, tok.Column = pos.Line+1, pos.Character+1
+	return tok
+}
+
+// rebaseProgram rebases the tokens of every node in program, see rebase.
+func (s *sourceText) rebaseProgram(program []parser.Statement) {
+	seen := make(map[*parser.NodeBase]bool)
+
+	for _, stmt := range program {
+		inspect(stmt, func(n parser.Node) bool {
+			if nb := nodeBase(n); nb != nil && !seen[nb] {
+				seen[nb] = true
+				nb.Token = s.rebase(nb.Token)
+			}
+			return true
+		})
+	}
+}
+
+// rebaseErrors rebases the token of every parse error in errs, and the
+// position they report with it.
+func (s *sourceText) rebaseErrors(errs []error) {
+	for _, err := range errs {
+		if pe, ok := err.(*parser.ParseError); ok && pe.Token.Line > 0 {
+			pe.Token = s.rebase(pe.Token)
+			pe.Line, pe.Column = pe.Token.Line, pe.Token.Column
+		}
+	}
+}
+
+func isWordTok(tok token.Token) bool {
+	if tok.Type == token.STRING {
+		return true
+	}
+	if tok.Literal == "" {
+		return false
+	}
+
+	ch := tok.Literal[0]
+	return ch == '_' ||
+		('a' <= ch && ch <= 'z') ||
+		('A' <= ch && ch <= 'Z') ||
+		('0' <= ch && ch <= '9')
+}
+
+// tokenSpan converts a rebased token to a 0-based range. only strings hold
+// line breaks, and their literal is their source text.
+func tokenSpan(tok token.Token) Range {
+	start := Position{Line: tok.Line - 1, Character: tok.Column - 1}
+
+	switch tok.Type {
+	case token.EOF:
+		return Range{Start: start, End: start}
+
+	case token.NEWLINE:
+		return Range{Start: start, End: Position{Line: start.Line + 1}}
+	}
+
+	lit := tok.Literal
+	if i := strings.LastIndexByte(lit, '\n'); i >= 0 {
+		end := Position{Line: start.Line + strings.Count(lit, "\n"), Character: utf16Len(lit[i+1:])}
+		return Range{Start: start, End: end}
+	}
+
+	end := Position{Line: start.Line, Character: start.Character + utf16Len(lit)}
+	return Range{Start: start, End: end}
+}
+
+func identRange(ident *parser.Identifier) Range {
+	return tokenSpan(ident.Token)
+}
+
+func posBefore(a, b Position) bool {
+	if a.Line != b.Line {
+		return a.Line < b.Line
+	}
+	return a.Character < b.Character
+}
+
+// rangeContains reports whether pos lies in r, treating the end as inclusive
+// so a cursor sitting right after a closing brace still counts as inside.
+func rangeContains(r Range, pos Position) bool {
+	return !posBefore(pos, r.Start) && !posBefore(r.End, pos)
+}
+
+// blockSpan finds the first '{' at or after from that is not nested in
+// parens or brackets and returns the range up to its matching '}'. an
+// unterminated block runs to the end of the document.
+func blockSpan(toks []token.Token, from Position) (Range, bool) {
+	depth := 0
+	open := -1
+
+	for i, tok := range toks {
+		if tok.Type == token.NEWLINE {
+			continue
+		}
+		if posBefore(tokenSpan(tok).Start, from) {
+			continue
+		}
+
+		switch tok.Type {
+		case token.LPAREN, token.LBRACKET:
+			depth++
+		case token.RPAREN, token.RBRACKET:
+			depth--
+		case token.LBRACE:
+			if depth == 0 {
+				open = i
+			}
+		}
+
+		if open >= 0 {
+			break
+		}
+	}
+
+	if open < 0 {
+		return Range{}, false
+	}
+
+	span := Range{Start: tokenSpan(toks[open]).Start}
+	braces := 0
+
+	for _, tok := range toks[open:] {
+		if tok.Type == token.NEWLINE {
+			continue
+		}
+
+		switch tok.Type {
+		case token.LBRACE:
+			braces++
+		case token.RBRACE:
+			braces--
+		}
+
+		span.End = tokenSpan(tok).End
+		if braces == 0 {
+			break
+		}
+	}
+
+	return span, true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/z-sk1/ayla-lang/parser"
+	"github.com/z-sk1/ayla-lang/token"
+)
+
+func TestLexTokens(t *testing.T) {
+	span := func(l1, c1, l2, c2 int) Range {
+		return Range{Start: Position{Line: l1, Character: c1}, End: Position{Line: l2, Character: c2}}
+	}
+
+	tests := []struct {
+		name string
+		text string
+		want []Range // spans of the tokens before EOF, newlines left out
+	}{
+		{
+			name: "word ending a line",
+			text: "egg x = abc\nexplodeln(x)\n",
+			want: []Range{
+				span(0, 0, 0, 3), span(0, 4, 0, 5), span(0, 6, 0, 7), span(0, 8, 0, 11),
+				span(1, 0, 1, 9), span(1, 9, 1, 10), span(1, 10, 1, 11), span(1, 11, 1, 12),
+			},
+		},
+		{
+			name: "number ending the text",
+			text: "egg x = 12",
+			want: []Range{span(0, 0, 0, 3), span(0, 4, 0, 5), span(0, 6, 0, 7), span(0, 8, 0, 10)},
+		},
+		{
+			name: "string ending a line",
+			text: "egg s = \"héllo\"\r\nx\n",
+			want: []Range{span(0, 0, 0, 3), span(0, 4, 0, 5), span(0, 6, 0, 7), span(0, 8, 0, 15), span(1, 0, 1, 1)},
+		},
+		{
+			name: "multi-line string",
+			text: "egg s = \"one\ntwo\"\nx\n",
+			want: []Range{span(0, 0, 0, 3), span(0, 4, 0, 5), span(0, 6, 0, 7), span(0, 8, 1, 4), span(2, 0, 2, 1)},
+		},
+		{
+			name: "after a surrogate pair",
+			text: "explodeln(\"😀\", x)\n",
+			want: []Range{span(0, 0, 0, 9), span(0, 9, 0, 10), span(0, 10, 0, 14), span(0, 14, 0, 15), span(0, 16, 0, 17), span(0, 17, 0, 18)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Range
+			for _, tok := range lexTokens(tt.text) {
+				if tok.Type != token.NEWLINE && tok.Type != token.EOF {
+					got = append(got, tokenSpan(tok))
+				}
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d tokens %v, want %d", len(got), got, len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("token %d: span %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestStringValue checks a string is parsed from the text as written, line
+// breaks in it included.
+func TestStringValue(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"egg s = \"one\"\n", "one"},
+		{"egg s = \"one\ntwo\"\n", "one\ntwo"},
+		{"egg s = \"one\n\nthree \"\n", "one\n\nthree "},
+		{"egg s = \"a\\tb\"\n", "a\tb"},
+	}
+
+	for _, tt := range tests {
+		program, _, errs := parseDocument(tt.text)
+		if len(errs) > 0 {
+			t.Fatalf("parseDocument(%q): %v", tt.text, errs[0])
+		}
+
+		var got *parser.StringLiteral
+		for _, stmt := range program {
+			inspect(stmt, func(n parser.Node) bool {
+				if lit, ok := n.(*parser.StringLiteral); ok {
+					got = lit
+				}
+				return got == nil
+			})
+		}
+
+		if got == nil {
+			t.Errorf("parseDocument(%q): no string literal", tt.text)
+			continue
+		}
+		if got.Value != tt.want {
+			t.Errorf("parseDocument(%q): value %q, want %q", tt.text, got.Value, tt.want)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/z-sk1/ayla-lang/parser"
+	"github.com/z-sk1/ayla-lang/token"
+)
+
+type ReferenceParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position Position `json:"position"`
+	Context  struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+func (s *Server) handleReferences(req *Request) {
+	var params ReferenceParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	a := s.analysis(params.TextDocument.URI)
+	if a == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	ident := findIdentAt(a.Program, params.Position)
+	if ident == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	sym := a.SymbolFor(ident)
+	if sym == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	locations := []Location{}
+	for _, ident := range symbolIdents(sym, params.Context.IncludeDeclaration) {
+		locations = append(locations, Location{
+			URI:   params.TextDocument.URI,
+			Range: identRange(ident),
+		})
+	}
+
+	s.sendResponse(req.ID, locations)
+}
+
+// symbolIdents returns every use of sym in source order, along with its
+// declaration when withDecl is set.
+func symbolIdents(sym *Symbol, withDecl bool) []*parser.Identifier {
+	var idents []*parser.Identifier
+	if withDecl && sym.Ident != nil {
+		idents = append(idents, sym.Ident)
+	}
+	idents = append(idents, sym.Refs...)
+
+	sort.SliceStable(idents, func(i, j int) bool {
+		return posBefore(identRange(idents[i]).Start, identRange(idents[j]).Start)
+	})
+
+	return idents
+}
+
+type PrepareRenameParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position Position `json:"position"`
+}
+
+type RenameParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position Position `json:"position"`
+	NewName  string   `json:"newName"`
+}
+
+func (s *Server) handlePrepareRename(req *Request) {
+	var params PrepareRenameParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	a := s.analysis(params.TextDocument.URI)
+	if a == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	ident := findIdentAt(a.Program, params.Position)
+	if ident == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	sym := a.SymbolFor(ident)
+	if sym == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	if msg := renameRefusal(sym); msg != "" {
+		s.sendError(req.ID, RequestFailed, msg)
+		return
+	}
+
+	s.sendResponse(req.ID, map[string]interface{}{
+		"range":       identRange(ident),
+		"placeholder": sym.Name,
+	})
+}
+
+func (s *Server) handleRename(req *Request) {
+	var params RenameParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	uri := params.TextDocument.URI
+	a := s.analysis(uri)
+	if a == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	ident := findIdentAt(a.Program, params.Position)
+	if ident == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	sym := a.SymbolFor(ident)
+	if sym == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	if msg := renameRefusal(sym); msg != "" {
+		s.sendError(req.ID, RequestFailed, msg)
+		return
+	}
+
+	if !isValidName(params.NewName) {
+		s.sendError(req.ID, RequestFailed, fmt.Sprintf("%q is not a valid name", params.NewName))
+		return
+	}
+
+	if msg := renameConflict(a.Root, sym, params.NewName); msg != "" {
+		s.sendError(req.ID, RequestFailed, msg)
+		return
+	}
+
+	edits := []TextEdit{}
+	for _, ident := range symbolIdents(sym, true) {
+		edits = append(edits, TextEdit{
+			Range:   identRange(ident),
+			NewText: params.NewName,
+		})
+	}
+
+	s.sendResponse(req.ID, WorkspaceEdit{
+		Changes: map[string][]TextEdit{uri: edits},
+	})
+}
+
+// renameRefusal explains why sym cannot be renamed at all, or returns "".
+func renameRefusal(sym *Symbol) string {
+	switch {
+	case sym.Kind == SymType:
+		return fmt.Sprintf("cannot rename builtin type %s", sym.Name)
+	case sym.Ident == nil:
+		return fmt.Sprintf("cannot rename builtin %s", sym.Name)
+	}
+	return ""
+}
+
+// isValidName reports whether name lexes as a single identifier, which
+// rules out keywords and builtin type names.
+func isValidName(name string) bool {
+	toks := lexTokens(name)
+	return len(toks) == 2 && toks[0].Type == token.IDENT && toks[0].Literal == name && name != "_"
+}
+
+// renameConflict explains why renaming sym to name would change what some
+// identifier refers to, or returns "".
+func renameConflict(root *Scope, sym *Symbol, name string) string {
+	// fields only clash with the other fields of their struct
+	if sym.Kind == SymStructField {
+		if other, ok := sym.Parent.Fields[name]; ok {
+			return fmt.Sprintf("%s already has a field %s%s", sym.Parent.Name, name, declaredAt(other))
+		}
+		return ""
+	}
+
+	if other, ok := sym.Scope.Symbols[name]; ok {
+		return fmt.Sprintf("%s is already declared in this scope%s", name, declaredAt(other))
+	}
+
+	// a use of sym inside a nested scope that declares name would be
+	// captured by that declaration
+	for _, ref := range sym.Refs {
+		for sc := root.ScopeAt(identRange(ref).Start); sc != nil && sc != sym.Scope; sc = sc.Parent {
+			if other, ok := sc.Symbols[name]; ok {
+				return fmt.Sprintf("%s would be captured by the declaration of %s%s", sym.Name, name, declaredAt(other))
+			}
+		}
+	}
+
+	// a use of another name inside sym's scope would be captured by sym
+	for _, other := range symbolsNamed(root, name) {
+		for _, ref := range other.Refs {
+			for sc := root.ScopeAt(identRange(ref).Start); sc != nil && sc != other.Scope; sc = sc.Parent {
+				if sc == sym.Scope {
+					return fmt.Sprintf("renamed %s would shadow %s used at %s", sym.Name, name, identPos(ref))
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+func declaredAt(sym *Symbol) string {
+	if sym.Ident == nil {
+		return " as a builtin"
+	}
+	return " at " + identPos(sym.Ident)
+}
+
+// identPos formats where ident starts as 1-based line:col.
+func identPos(ident *parser.Identifier) string {
+	start := identRange(ident).Start
+	return fmt.Sprintf("%d:%d", start.Line+1, start.Character+1)
+}
+
+// symbolsNamed returns every symbol called name in the tree s belongs to.
+func symbolsNamed(s *Scope, name string) []*Symbol {
+	top := s
+	for top.Parent != nil {
+		top = top.Parent
+	}
+
+	var syms []*Symbol
+	var walk func(sc *Scope)
+	walk = func(sc *Scope) {
+		if sym, ok := sc.Symbols[name]; ok {
+			syms = append(syms, sym)
+		}
+		for _, child := range sc.Children {
+			walk(child)
+		}
+	}
+	walk(top)
+
+	return syms
+}
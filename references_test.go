@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenameConflict(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		at      Position // an identifier of the symbol to rename
+		newName string
+		want    string // a substring of the conflict, "" for none
+	}{
+		{
+			name:    "free name",
+			src:     "egg a = 1\nexplodeln(a)\n",
+			at:      Position{Line: 0, Character: 4},
+			newName: "b",
+		},
+		{
+			name:    "declared in the same scope",
+			src:     "egg a = 1\negg b = 2\nexplodeln(a + b)\n",
+			at:      Position{Line: 0, Character: 4},
+			newName: "b",
+			want:    "b is already declared in this scope at 2:5",
+		},
+		{
+			name:    "captured by an inner declaration",
+			src:     "egg a = 1\nfun f() {\n    egg b = 2\n    explodeln(a + b)\n}\n",
+			at:      Position{Line: 0, Character: 4},
+			newName: "b",
+			want:    "a would be captured by the declaration of b at 3:9",
+		},
+		{
+			name:    "inner declaration not reached by a use",
+			src:     "egg a = 1\nfun f() {\n    egg b = 2\n    explodeln(b)\n}\nexplodeln(a)\n",
+			at:      Position{Line: 0, Character: 4},
+			newName: "b",
+		},
+		{
+			name:    "shadowing a name used in the inner scope",
+			src:     "egg a = 1\nfun f() {\n    egg x = 2\n    explodeln(a + x)\n}\n",
+			at:      Position{Line: 2, Character: 8},
+			newName: "a",
+			want:    "renamed x would shadow a used at 4:15",
+		},
+		{
+			name:    "shadowing a name not used in the inner scope",
+			src:     "egg a = 1\nfun f() {\n    egg x = 2\n    explodeln(x)\n}\nexplodeln(a)\n",
+			at:      Position{Line: 2, Character: 8},
+			newName: "a",
+		},
+		{
+			name:    "shadowing a builtin that is used",
+			src:     "fun f() {\n    egg x = 2\n    explodeln(x)\n}\n",
+			at:      Position{Line: 1, Character: 8},
+			newName: "explodeln",
+			want:    "renamed x would shadow explodeln used at 3:5",
+		},
+		{
+			name:    "field clashing with a field",
+			src:     "type Person struct {\n    Name string\n    Age int\n}\negg p = Person{Name: \"a\", Age: 1}\nexplodeln(p.Name)\n",
+			at:      Position{Line: 5, Character: 12},
+			newName: "Age",
+			want:    "Person already has a field Age at 3:5",
+		},
+		{
+			name:    "field named like a variable",
+			src:     "type Person struct {\n    Name string\n}\negg Title = 1\negg p = Person{Name: \"a\"}\nexplodeln(p.Name, Title)\n",
+			at:      Position{Line: 5, Character: 12},
+			newName: "Title",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := analyze(tt.src, 1)
+			sym := symbolAtPos(t, a, tt.at)
+
+			got := renameConflict(a.Root, sym, tt.newName)
+			switch {
+			case tt.want == "" && got != "":
+				t.Errorf("conflict %q, want none", got)
+			case tt.want != "" && !strings.Contains(got, tt.want):
+				t.Errorf("conflict %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenameRefusal(t *testing.T) {
+	src := "egg a int = len(\"x\")\nexplodeln(a)\n"
+
+	tests := []struct {
+		name string
+		at   Position
+		want string
+	}{
+		{"variable", Position{Line: 0, Character: 4}, ""},
+		{"builtin function", Position{Line: 1, Character: 2}, "cannot rename builtin explodeln"},
+		{"builtin function in an expression", Position{Line: 0, Character: 13}, "cannot rename builtin len"},
+		{"builtin type", Position{Line: 0, Character: 7}, "cannot rename builtin type int"},
+	}
+
+	a := analyze(src, 1)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renameRefusal(symbolAtPos(t, a, tt.at)); got != tt.want {
+				t.Errorf("refusal %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsValidName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"a", true},
+		{"camelCase", true},
+		{"snake_case2", true},
+		{"", false},
+		{"_", false},
+		{"2a", false},
+		{"a b", false},
+		{"a.b", false},
+		{"egg", false},
+		{"fun", false},
+		{"int", false},
+	}
+
+	for _, tt := range tests {
+		if got := isValidName(tt.name); got != tt.want {
+			t.Errorf("isValidName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// symbolAtPos returns the symbol of the identifier at pos in a.
+func symbolAtPos(t *testing.T, a *Analysis, pos Position) *Symbol {
+	t.Helper()
+
+	ident := findIdentAt(a.Program, pos)
+	if ident == nil {
+		t.Fatalf("no identifier at %v", pos)
+	}
+	sym := a.SymbolFor(ident)
+	if sym == nil {
+		t.Fatalf("%s at %v has no symbol", ident.Value, pos)
+	}
+	return sym
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/z-sk1/ayla-lang/parser"
+)
+
+// the legend sent with the capabilities, token types and modifiers are
+// indexes into these
+var semanticTokenTypes = []string{
+	"variable", "parameter", "function", "type", "struct", "property", "enum", "enumMember",
+}
+
+var semanticTokenModifiers = []string{
+	"declaration", "readonly", "defaultLibrary",
+}
+
+const (
+	semVariable = iota
+	semParameter
+	semFunction
+	semType
+	semStruct
+	semProperty
+	semEnum
+	semEnumMember
+)
+
+const (
+	semDeclaration = 1 << iota
+	semReadonly
+	semDefaultLibrary
+)
+
+type SemanticTokensParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+}
+
+type SemanticTokensDeltaParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	PreviousResultID string `json:"previousResultId"`
+}
+
+type SemanticTokensRangeParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Range Range `json:"range"`
+}
+
+type SemanticTokens struct {
+	ResultID string `json:"resultId,omitempty"`
+	Data     []int  `json:"data"`
+}
+
+type SemanticTokensDelta struct {
+	ResultID string               `json:"resultId"`
+	Edits    []SemanticTokensEdit `json:"edits"`
+}
+
+type SemanticTokensEdit struct {
+	Start       int   `json:"start"`
+	DeleteCount int   `json:"deleteCount"`
+	Data        []int `json:"data"`
+}
+
+// semanticResult is a set of tokens sent to the client, kept to diff the
+// next set against.
+type semanticResult struct {
+	id   string
+	data []int
+}
+
+type semanticToken struct {
+	Range     Range
+	Type      int
+	Modifiers int
+}
+
+func (s *Server) handleSemanticTokensFull(req *Request) {
+	var params SemanticTokensParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	uri := params.TextDocument.URI
+	a := s.analysis(uri)
+	if a == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	data := encodeSemanticTokens(semanticTokens(a))
+	s.sendResponse(req.ID, SemanticTokens{
+		ResultID: s.storeSemanticTokens(uri, data),
+		Data:     data,
+	})
+}
+
+func (s *Server) handleSemanticTokensDelta(req *Request) {
+	var params SemanticTokensDeltaParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	uri := params.TextDocument.URI
+	a := s.analysis(uri)
+	if a == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	data := encodeSemanticTokens(semanticTokens(a))
+
+	s.semMu.Lock()
+	prev, ok := s.semTokens[uri]
+	s.semMu.Unlock()
+
+	id := s.storeSemanticTokens(uri, data)
+
+	// without the tokens the client has, all it can get is the full set
+	if !ok || prev.id != params.PreviousResultID {
+		s.sendResponse(req.ID, SemanticTokens{ResultID: id, Data: data})
+		return
+	}
+
+	edits := []SemanticTokensEdit{}
+	if edit, changed := diffSemanticTokens(prev.data, data); changed {
+		edits = append(edits, edit)
+	}
+
+	s.sendResponse(req.ID, SemanticTokensDelta{ResultID: id, Edits: edits})
+}
+
+func (s *Server) handleSemanticTokensRange(req *Request) {
+	var params SemanticTokensRangeParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	a := s.analysis(params.TextDocument.URI)
+	if a == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	var toks []semanticToken
+	for _, tok := range semanticTokens(a) {
+		if rangeContains(params.Range, tok.Range.Start) && posBefore(tok.Range.Start, params.Range.End) {
+			toks = append(toks, tok)
+		}
+	}
+
+	s.sendResponse(req.ID, SemanticTokens{Data: encodeSemanticTokens(toks)})
+}
+
+// storeSemanticTokens remembers data as the tokens last sent for uri and
+// returns the result id naming them.
+func (s *Server) storeSemanticTokens(uri string, data []int) string {
+	s.semMu.Lock()
+	defer s.semMu.Unlock()
+
+	s.lastResultID++
+	id := strconv.FormatInt(s.lastResultID, 10)
+	s.semTokens[uri] = semanticResult{id: id, data: data}
+	return id
+}
+
+// semanticTokens classifies every identifier the analysis resolved, in
+// source order.
+func semanticTokens(a *Analysis) []semanticToken {
+	var toks []semanticToken
+	seen := make(map[Position]bool)
+
+	push := func(ident *parser.Identifier, typ, mods int) {
+		r := identRange(ident)
+		if seen[r.Start] || r.Start.Line != r.End.Line {
+			return
+		}
+		seen[r.Start] = true
+		toks = append(toks, semanticToken{Range: r, Type: typ, Modifiers: mods})
+	}
+
+	add := func(ident *parser.Identifier, sym *Symbol, decl bool) {
+		typ, mods := semanticKind(sym)
+		if decl {
+			mods |= semDeclaration
+		}
+		push(ident, typ, mods)
+	}
+
+	var addSym func(sym *Symbol)
+	addSym = func(sym *Symbol) {
+		if sym.Ident != nil {
+			add(sym.Ident, sym, true)
+		}
+		for _, ref := range sym.Refs {
+			add(ref, sym, false)
+		}
+		for _, field := range sym.Fields {
+			addSym(field)
+		}
+
+		if enum, ok := sym.Decl.(*parser.EnumStatement); ok && sym.Kind == SymUserType {
+			for _, variant := range enum.Variants {
+				if variant != nil {
+					push(variant, semEnumMember, semDeclaration|semReadonly)
+				}
+			}
+		}
+	}
+
+	var walk func(sc *Scope)
+	walk = func(sc *Scope) {
+		for _, sym := range sc.Symbols {
+			addSym(sym)
+		}
+		for _, child := range sc.Children {
+			walk(child)
+		}
+	}
+	walk(a.Root.Parent)
+
+	sort.Slice(toks, func(i, j int) bool {
+		return posBefore(toks[i].Range.Start, toks[j].Range.Start)
+	})
+
+	return toks
+}
+
+// semanticKind returns the token type and modifiers for uses of sym.
+func semanticKind(sym *Symbol) (int, int) {
+	switch sym.Kind {
+	case SymConst:
+		return semVariable, semReadonly
+	case SymParam:
+		return semParameter, 0
+	case SymFunc:
+		if sym.Ident == nil {
+			return semFunction, semDefaultLibrary
+		}
+		return semFunction, 0
+	case SymType:
+		return semType, semDefaultLibrary
+	case SymStructField:
+		return semProperty, 0
+	case SymUserType:
+		if _, ok := sym.Decl.(*parser.EnumStatement); ok {
+			return semEnum, 0
+		}
+		if _, ok := sym.Type.(*parser.StructType); ok {
+			return semStruct, 0
+		}
+		return semType, 0
+	}
+	return semVariable, 0
+}
+
+// encodeSemanticTokens packs tokens sorted by position into the relative
+// form the spec asks for: line delta, start delta, length, type, modifiers.
+func encodeSemanticTokens(toks []semanticToken) []int {
+	data := make([]int, 0, len(toks)*5)
+	prev := Position{}
+
+	for _, tok := range toks {
+		start := tok.Range.Start
+
+		deltaStart := start.Character
+		if start.Line == prev.Line {
+			deltaStart -= prev.Character
+		}
+
+		data = append(data,
+			start.Line-prev.Line,
+			deltaStart,
+			tok.Range.End.Character-start.Character,
+			tok.Type,
+			tok.Modifiers,
+		)
+		prev = start
+	}
+
+	return data
+}
+
+// diffSemanticTokens describes the change from prev to next as a single
+// edit replacing everything between their common prefix and suffix.
+func diffSemanticTokens(prev, next []int) (SemanticTokensEdit, bool) {
+	start := 0
+	for start < len(prev) && start < len(next) && prev[start] == next[start] {
+		start++
+	}
+
+	if start == len(prev) && start == len(next) {
+		return SemanticTokensEdit{}, false
+	}
+
+	end := 0
+	for end < len(prev)-start && end < len(next)-start &&
+		prev[len(prev)-1-end] == next[len(next)-1-end] {
+		end++
+	}
+
+	return SemanticTokensEdit{
+		Start:       start,
+		DeleteCount: len(prev) - start - end,
+		Data:        next[start : len(next)-end],
+	}, true
+}
@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"os"
+	"mime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
 
-	"github.com/z-sk1/ayla-lang/lexer"
 	"github.com/z-sk1/ayla-lang/parser"
 	"github.com/z-sk1/ayla-lang/token"
 )
@@ -17,21 +20,92 @@ type Server struct {
 	in  *bufio.Reader
 	out *bufio.Writer
 
-	documents map[string]string
+	// writeMu keeps concurrent handlers from interleaving messages
+	writeMu sync.Mutex
+
+	// mu guards documents. a Document is never changed once stored, edits
+	// replace it, so handlers can keep using the one they looked up.
+	mu        sync.Mutex
+	documents map[string]*Document
+
+	// inflight maps the ID of every request still owed a response to
+	// whether the client has cancelled it
+	inflightMu sync.Mutex
+	inflight   map[RequestID]bool
+	wg         sync.WaitGroup
+
+	// semTokens holds the semantic tokens last sent for each document, so
+	// the next request for them can be answered with a delta
+	semMu        sync.Mutex
+	semTokens    map[string]semanticResult
+	lastResultID int64
+
+	// lifecycle, only touched on the reader goroutine
+	initialized  bool
+	shuttingDown bool
+	exited       bool
+
+	// showInternalErrors reports handler panics to the user as well as
+	// the log, set from the initialize options
+	showInternalErrors bool
 }
 
+// Request is any message from the client: a request, a notification
+// without an ID, or a response, which has Result or Error instead of Method.
 type Request struct {
 	Jsonrpc string          `json:"jsonrpc"`
-	ID      *int            `json:"id,omitempty"`
+	ID      *RequestID      `json:"id,omitempty"`
 	Method  string          `json:"method"`
 	Params  json.RawMessage `json:"params,omitempty"`
+
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *ResponseError  `json:"error,omitempty"`
+}
+
+// RequestID is a JSON-RPC request id, which may be a string or an integer.
+type RequestID struct {
+	Num      int64
+	Str      string
+	IsString bool
+}
+
+func (id RequestID) MarshalJSON() ([]byte, error) {
+	if id.IsString {
+		return json.Marshal(id.Str)
+	}
+	return json.Marshal(id.Num)
+}
+
+func (id *RequestID) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*id = RequestID{Str: str, IsString: true}
+		return nil
+	}
+
+	var num int64
+	if err := json.Unmarshal(data, &num); err != nil {
+		return fmt.Errorf("request id must be a string or an integer, got %s", data)
+	}
+	*id = RequestID{Num: num}
+	return nil
+}
+
+func (id RequestID) String() string {
+	if id.IsString {
+		return strconv.Quote(id.Str)
+	}
+	return strconv.FormatInt(id.Num, 10)
 }
 
 type Response struct {
-	Jsonrpc string      `json:"jsonrpc"`
-	ID      *int        `json:"id"`
-	Result  interface{} `json:"result"`
-	Error   interface{} `json:"error,omitempty"`
+	Jsonrpc string     `json:"jsonrpc"`
+	ID      *RequestID `json:"id"`
+
+	// exactly one of Result and Error is set. a null result is the JSON
+	// text "null", so it is still sent.
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *ResponseError  `json:"error,omitempty"`
 }
 
 type Position struct {
@@ -45,25 +119,77 @@ type Range struct {
 }
 
 type Diagnostic struct {
-	Range    Range  `json:"range"`
-	Severity int    `json:"severity"` // 1 = Error
-	Message  string `json:"message"`
+	Range              Range                          `json:"range"`
+	Severity           int                            `json:"severity"` // 1 = Error, 2 = Warning
+	Code               string                         `json:"code,omitempty"`
+	Message            string                         `json:"message"`
+	RelatedInformation []DiagnosticRelatedInformation `json:"relatedInformation,omitempty"`
+}
+
+type DiagnosticRelatedInformation struct {
+	Location Location `json:"location"`
+	Message  string   `json:"message"`
+}
+
+type InitializeParams struct {
+	InitializationOptions struct {
+		// defaults to true
+		ShowInternalErrors *bool `json:"showInternalErrors"`
+	} `json:"initializationOptions"`
 }
 
+type ShowMessageParams struct {
+	Type    int    `json:"type"`
+	Message string `json:"message"`
+}
+
+type LogMessageParams struct {
+	Type    int    `json:"type"`
+	Message string `json:"message"`
+}
+
+// MessageType values for window/showMessage and window/logMessage
+const (
+	MessageTypeError   = 1
+	MessageTypeWarning = 2
+	MessageTypeInfo    = 3
+	MessageTypeLog     = 4
+)
+
 type DidOpenParams struct {
 	TextDocument struct {
-		URI  string `json:"uri"`
-		Text string `json:"text"`
+		URI     string `json:"uri"`
+		Version int    `json:"version"`
+		Text    string `json:"text"`
 	} `json:"textDocument"`
 }
 
 type DidChangeParams struct {
+	TextDocument struct {
+		URI     string `json:"uri"`
+		Version int    `json:"version"`
+	} `json:"textDocument"`
+	ContentChanges []TextDocumentContentChangeEvent `json:"contentChanges"`
+}
+
+type DidCloseParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+}
+
+type DidSaveParams struct {
 	TextDocument struct {
 		URI string `json:"uri"`
 	} `json:"textDocument"`
-	ContentChanges []struct {
-		Text string `json:"text"`
-	} `json:"contentChanges"`
+	Text *string `json:"text,omitempty"` // set when the client includes it
+}
+
+type WillSaveParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Reason int `json:"reason"` // 1 = Manual, 2 = AfterDelay, 3 = FocusOut
 }
 
 type DefinitionParams struct {
@@ -85,42 +211,242 @@ type HoverParams struct {
 	Position Position `json:"position"`
 }
 
-type HoverResult struct {
-	Contents interface{} `json:"contents"`
+type TextEdit struct {
+	Range   Range  `json:"range"`
+	NewText string `json:"newText"`
 }
 
-func main() {
-	f, err := os.Create("ayla-lsp.log")
-	if err == nil {
-		log.SetOutput(f)
-	}
+type WorkspaceEdit struct {
+	Changes map[string][]TextEdit `json:"changes"`
+}
+
+type ResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
+// JSON-RPC and LSP error codes
+const (
+	ParseError           = -32700
+	InvalidRequest       = -32600
+	MethodNotFound       = -32601
+	InvalidParams        = -32602
+	InternalError        = -32603
+	ServerNotInitialized = -32002
+	RequestCancelled     = -32800
+	RequestFailed        = -32803 // a valid request that could not be carried out
+)
 
-	server := NewServer()
-	server.Run()
+type HoverResult struct {
+	Contents interface{} `json:"contents"`
 }
 
-func NewServer() *Server {
+// NewServer returns a server for one client talking over in and out.
+func NewServer(in io.Reader, out io.Writer) *Server {
 	return &Server{
-		in:        bufio.NewReader(os.Stdin),
-		out:       bufio.NewWriter(os.Stdout),
-		documents: make(map[string]string),
+		in:        bufio.NewReader(in),
+		out:       bufio.NewWriter(out),
+		documents: make(map[string]*Document),
+		inflight:  make(map[RequestID]bool),
+		semTokens: make(map[string]semanticResult),
 	}
 }
 
-func (s *Server) Run() {
-	for {
+// concurrentMethods only read document snapshots, so they run on their own
+// goroutine. everything else, document changes above all, runs in order on
+// the reader goroutine.
+var concurrentMethods = map[string]bool{
+	"textDocument/definition":     true,
+	"textDocument/hover":          true,
+	"textDocument/completion":     true,
+	"textDocument/references":     true,
+	"textDocument/documentSymbol": true,
+	"textDocument/prepareRename":  true,
+	"textDocument/rename":         true,
+	"textDocument/signatureHelp":  true,
+
+	"textDocument/semanticTokens/full":       true,
+	"textDocument/semanticTokens/full/delta": true,
+	"textDocument/semanticTokens/range":      true,
+
+	"textDocument/formatting":      true,
+	"textDocument/rangeFormatting": true,
+
+	"textDocument/codeAction": true,
+}
+
+// Run serves the client until it sends exit or closes the stream. it
+// returns the exit code the spec asks for: 0 if the client shut the server
+// down first, 1 otherwise.
+func (s *Server) Run() int {
+	for !s.exited {
 		msg, err := readMessage(s.in)
+		if rerr, ok := err.(*ResponseError); ok {
+			// the request could not be read, so neither could its id
+			s.writeResponse(Response{Jsonrpc: "2.0", Error: rerr})
+			continue
+		}
 		if err != nil {
+			if err != io.EOF {
+				log.Printf("reading message: %v", err)
+			}
+			break
+		}
+
+		s.dispatch(msg)
+	}
+
+	s.wg.Wait()
+
+	if s.shuttingDown {
+		return 0
+	}
+	return 1
+}
+
+func (s *Server) dispatch(req *Request) {
+	if req.Method == "" && req.ID != nil && (req.Result != nil || req.Error != nil) {
+		// the server sends no requests, so nothing is waiting for this
+		log.Printf("response to unknown request %s", req.ID)
+		return
+	}
+
+	if req.Jsonrpc != "2.0" || req.Method == "" {
+		log.Printf("invalid request: jsonrpc %q, method %q", req.Jsonrpc, req.Method)
+		if req.ID != nil {
+			s.writeResponse(Response{
+				Jsonrpc: "2.0",
+				ID:      req.ID,
+				Error:   &ResponseError{Code: InvalidRequest, Message: "invalid request"},
+			})
+		}
+		return
+	}
+
+	if req.Method == "$/cancelRequest" {
+		s.handleCancelRequest(req)
+		return
+	}
+
+	if req.ID != nil {
+		s.inflightMu.Lock()
+		s.inflight[*req.ID] = false
+		s.inflightMu.Unlock()
+	}
+
+	switch {
+	case req.Method == "exit":
+		// always honored
+
+	case !s.initialized && req.Method != "initialize":
+		// notifications before initialize are dropped
+		s.sendError(req.ID, ServerNotInitialized, "server not initialized")
+		return
+
+	case s.shuttingDown:
+		s.sendError(req.ID, InvalidRequest, "server is shutting down")
+		return
+	}
+
+	if !concurrentMethods[req.Method] {
+		s.handle(req)
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.handle(req)
+	}()
+}
+
+// handle runs the handler for req and makes sure a request is answered
+// even when the handler did not. a panicking handler fails only its own
+// request.
+func (s *Server) handle(req *Request) {
+	defer func() {
+		r := recover()
+		if r == nil {
 			return
 		}
 
-		s.handleMessage(msg)
+		log.Printf("panic handling %s: %v\n%s", req.Method, r, debug.Stack())
+
+		msg := fmt.Sprintf("internal error handling %s: %v", req.Method, r)
+		s.sendError(req.ID, InternalError, msg)
+
+		if s.showInternalErrors {
+			s.sendNotification("window/showMessage", ShowMessageParams{
+				Type:    MessageTypeError,
+				Message: "elen: " + msg,
+			})
+		}
+	}()
+
+	s.handleMessage(req)
+
+	if req.ID == nil {
+		return
+	}
+
+	s.inflightMu.Lock()
+	_, unanswered := s.inflight[*req.ID]
+	s.inflightMu.Unlock()
+
+	if unanswered {
+		log.Printf("%s left request %s unanswered", req.Method, req.ID)
+		s.sendResponse(req.ID, nil)
 	}
 }
 
-func (s *Server) handleMessage(req *Request) {
-	fmt.Fprintf(os.Stderr, "METHOD: %s\n", req.Method)
+// decodeParams unmarshals the params of req into v. a request that fails
+// gets an InvalidParams error, a notification is just logged.
+func (s *Server) decodeParams(req *Request, v interface{}) bool {
+	err := json.Unmarshal(req.Params, v)
+	if err == nil {
+		return true
+	}
+
+	log.Printf("%s: invalid params: %v", req.Method, err)
+	s.sendError(req.ID, InvalidParams, err.Error())
+	return false
+}
+
+type CancelParams struct {
+	ID RequestID `json:"id"`
+}
+
+func (s *Server) handleCancelRequest(req *Request) {
+	var params CancelParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
 
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+
+	// a request that already answered has nothing left to cancel
+	if _, ok := s.inflight[params.ID]; ok {
+		s.inflight[params.ID] = true
+	}
+}
+
+// finish forgets a request about to be answered. it reports whether the
+// client cancelled it and whether it was still owed a response at all.
+func (s *Server) finish(id RequestID) (cancelled, pending bool) {
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+
+	cancelled, pending = s.inflight[id]
+	delete(s.inflight, id)
+	return cancelled, pending
+}
+
+func (s *Server) handleMessage(req *Request) {
 	switch req.Method {
 	case "initialize":
 		s.handleIntialize(req)
@@ -134,26 +460,131 @@ func (s *Server) handleMessage(req *Request) {
 	case "textDocument/didChange":
 		s.handleDidChange(req)
 
+	case "textDocument/willSave":
+		s.handleWillSave(req)
+
+	case "textDocument/didSave":
+		s.handleDidSave(req)
+
+	case "textDocument/didClose":
+		s.handleDidClose(req)
+
 	case "textDocument/definition":
 		s.handleDefinition(req)
 
 	case "textDocument/hover":
 		s.handleHover(req)
 
+	case "textDocument/completion":
+		s.handleCompletion(req)
+
+	case "textDocument/references":
+		s.handleReferences(req)
+
+	case "textDocument/documentSymbol":
+		s.handleDocumentSymbol(req)
+
+	case "textDocument/prepareRename":
+		s.handlePrepareRename(req)
+
+	case "textDocument/rename":
+		s.handleRename(req)
+
+	case "textDocument/signatureHelp":
+		s.handleSignatureHelp(req)
+
+	case "textDocument/semanticTokens/full":
+		s.handleSemanticTokensFull(req)
+
+	case "textDocument/semanticTokens/full/delta":
+		s.handleSemanticTokensDelta(req)
+
+	case "textDocument/semanticTokens/range":
+		s.handleSemanticTokensRange(req)
+
+	case "textDocument/formatting":
+		s.handleFormatting(req)
+
+	case "textDocument/rangeFormatting":
+		s.handleRangeFormatting(req)
+
+	case "textDocument/codeAction":
+		s.handleCodeAction(req)
+
 	case "shutdown":
+		// let running requests answer first
+		s.wg.Wait()
+		s.shuttingDown = true
 		s.sendResponse(req.ID, nil)
 
 	case "exit":
-		os.Exit(0)
+		s.exited = true
+
+	default:
+		if req.ID != nil {
+			s.sendError(req.ID, MethodNotFound, fmt.Sprintf("method not found: %s", req.Method))
+		} else if !strings.HasPrefix(req.Method, "$/") {
+			log.Printf("unhandled notification %s", req.Method)
+		}
 	}
 }
 
 func (s *Server) handleIntialize(req *Request) {
+	if s.initialized {
+		s.sendError(req.ID, InvalidRequest, "server already initialized")
+		return
+	}
+
+	var params InitializeParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	s.initialized = true
+
+	s.showInternalErrors = true
+	if show := params.InitializationOptions.ShowInternalErrors; show != nil {
+		s.showInternalErrors = *show
+	}
+
 	result := map[string]interface{}{
 		"capabilities": map[string]interface{}{
-			"textDocumentSync":   1,
-			"definitionProvider": true,
-			"hoverProvider":      true,
+			"textDocumentSync": map[string]interface{}{
+				"openClose": true,
+				"change":    2, // incremental
+				"willSave":  true,
+				"save": map[string]interface{}{
+					"includeText": true,
+				},
+			},
+			"definitionProvider":     true,
+			"hoverProvider":          true,
+			"referencesProvider":     true,
+			"documentSymbolProvider": true,
+			"renameProvider": map[string]interface{}{
+				"prepareProvider": true,
+			},
+			"completionProvider": map[string]interface{}{
+				"triggerCharacters": []string{"."},
+			},
+			"signatureHelpProvider": map[string]interface{}{
+				"triggerCharacters": []string{"(", ","},
+			},
+			"semanticTokensProvider": map[string]interface{}{
+				"legend": map[string]interface{}{
+					"tokenTypes":     semanticTokenTypes,
+					"tokenModifiers": semanticTokenModifiers,
+				},
+				"full": map[string]interface{}{
+					"delta": true,
+				},
+				"range": true,
+			},
+			"documentFormattingProvider":      true,
+			"documentRangeFormattingProvider": true,
+			"codeActionProvider": map[string]interface{}{
+				"codeActionKinds": []string{"quickfix"},
+			},
 		},
 	}
 
@@ -162,63 +593,186 @@ func (s *Server) handleIntialize(req *Request) {
 
 func (s *Server) handleDidOpen(req *Request) {
 	var params DidOpenParams
-	json.Unmarshal(req.Params, &params)
+	if !s.decodeParams(req, &params) {
+		return
+	}
 
 	uri := params.TextDocument.URI
 	text := params.TextDocument.Text
 
-	s.documents[uri] = text
+	doc := &Document{
+		URI:     uri,
+		Text:    text,
+		Version: params.TextDocument.Version,
+	}
+	s.storeDocument(doc)
 
 	// run diagnostics
-	s.publishDiagnostics(uri, text)
+	s.publishDiagnostics(uri, doc.Analysis())
 }
 
 func (s *Server) handleDidChange(req *Request) {
 	var params DidChangeParams
-	json.Unmarshal(req.Params, &params)
+	if !s.decodeParams(req, &params) {
+		return
+	}
 
 	uri := params.TextDocument.URI
-	text := params.ContentChanges[0].Text
 
-	s.documents[uri] = text
-	s.publishDiagnostics(uri, text)
+	doc := s.document(uri)
+	if doc == nil {
+		log.Printf("didChange for unopened document %s", uri)
+		return
+	}
+
+	// the last good text keeps being served, the client is told why its
+	// edits are missing
+	if params.TextDocument.Version <= doc.Version {
+		s.rejectChange(uri, fmt.Sprintf("stale version %d, have %d", params.TextDocument.Version, doc.Version))
+		return
+	}
+
+	next := &Document{
+		URI:     uri,
+		Text:    doc.Text,
+		Version: params.TextDocument.Version,
+	}
+
+	// changes apply one after another, each to the result of the last
+	for _, change := range params.ContentChanges {
+		if err := next.ApplyChange(change); err != nil {
+			s.rejectChange(uri, err.Error())
+			return
+		}
+	}
+
+	s.storeDocument(next)
+
+	if next.Text != doc.Text {
+		s.publishDiagnostics(uri, next.Analysis())
+	}
 }
 
-func (s *Server) handleHover(req *Request) {
-	var params HoverParams
-	json.Unmarshal(req.Params, &params)
+func (s *Server) handleWillSave(req *Request) {
+	var params WillSaveParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
 
-	text := s.documents[params.TextDocument.URI]
-	if text == "" {
-		s.sendResponse(req.ID, nil)
+	// nothing to do before a save yet, edits would go in willSaveWaitUntil
+	log.Printf("willSave %s (reason %d)", params.TextDocument.URI, params.Reason)
+}
+
+func (s *Server) handleDidSave(req *Request) {
+	var params DidSaveParams
+	if !s.decodeParams(req, &params) {
 		return
 	}
 
-	l := lexer.New(text)
-	p := parser.New(l)
-	program := p.ParseProgram()
-	rootScope := BuildSymbols(program)
+	uri := params.TextDocument.URI
 
-	ident := findIdentAt(program, params.Position)
-	if ident == nil {
-		s.sendResponse(req.ID, nil)
+	doc := s.document(uri)
+	if doc == nil {
+		log.Printf("didSave for unopened document %s", uri)
 		return
 	}
 
-	sym := rootScope.Resolve(ident.Value)
-	if sym == nil {
+	// the saved text is authoritative if we drifted from the client
+	if params.Text != nil && *params.Text != doc.Text {
+		doc = &Document{
+			URI:     uri,
+			Text:    *params.Text,
+			Version: doc.Version,
+		}
+		s.storeDocument(doc)
+	}
+
+	s.publishDiagnostics(uri, doc.Analysis())
+}
+
+func (s *Server) handleDidClose(req *Request) {
+	var params DidCloseParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	uri := params.TextDocument.URI
+
+	s.mu.Lock()
+	delete(s.documents, uri)
+	s.mu.Unlock()
+
+	s.semMu.Lock()
+	delete(s.semTokens, uri)
+	s.semMu.Unlock()
+
+	// clear what we published, the file may not even exist any more
+	s.sendNotification("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri":         uri,
+		"diagnostics": []Diagnostic{},
+	})
+}
+
+// rejectChange reports a didChange that could not be applied. the whole
+// notification is dropped and the document keeps its last good version.
+func (s *Server) rejectChange(uri, reason string) {
+	log.Printf("didChange %s: %s", uri, reason)
+
+	s.sendNotification("window/logMessage", LogMessageParams{
+		Type:    MessageTypeError,
+		Message: fmt.Sprintf("elen: ignored a change to %s: %s", uri, reason),
+	})
+}
+
+// document returns the current version of an open document, or nil.
+func (s *Server) document(uri string) *Document {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.documents[uri]
+}
+
+func (s *Server) storeDocument(doc *Document) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.documents[doc.URI] = doc
+}
+
+func (s *Server) handleHover(req *Request) {
+	var params HoverParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	a := s.analysis(params.TextDocument.URI)
+	if a == nil {
 		s.sendResponse(req.ID, nil)
 		return
 	}
 
-	if sym.Type == nil && sym.Value != nil {
-		inferred := inferExprType(rootScope, sym.Value)
-		if inferred != nil {
-			sym.Type = inferred
-		}
+	var sym *Symbol
+	if ident := findIdentAt(a.Program, params.Position); ident != nil {
+		sym = a.SymbolFor(ident)
 	}
 
-	hoverText := hoverFromSymbol(sym)
+	var hoverText string
+	if sym != nil {
+		// a call's name shows the function's signature like any other use
+		hoverText = hoverFromSymbol(sym)
+	} else if site, inCall := callAt(a.Tokens, params.Position); inCall {
+		// an argument with nothing of its own to show, such as a literal,
+		// shows the param it fills
+		fn := a.callee(site)
+		if fn == nil {
+			s.sendResponse(req.ID, nil)
+			return
+		}
+		hoverText = callHover(fn, site.Arg)
+	} else {
+		s.sendResponse(req.ID, nil)
+		return
+	}
 
 	hover := HoverResult{
 		Contents: map[string]interface{}{
@@ -243,6 +797,9 @@ func typeNodeToString(t parser.TypeNode) string {
 	case *parser.ArrayType:
 		return "[]" + typeNodeToString(tt.Elem)
 
+	case *parser.MapType:
+		return fmt.Sprintf("map[%s]%s", typeNodeToString(tt.Key), typeNodeToString(tt.Value))
+
 	case *parser.StructType:
 		return "struct" // or expand fields later
 
@@ -251,71 +808,103 @@ func typeNodeToString(t parser.TypeNode) string {
 	}
 }
 
-func hoverFromSymbol(sym *Symbol) string {
-	typeStr := typeNodeToString(sym.Type)
+// structTypeString renders a struct type with one field per line.
+func structTypeString(st *parser.StructType) string {
+	var fields strings.Builder
+	for _, field := range st.Fields {
+		if field == nil || field.Name == nil {
+			continue
+		}
+		fmt.Fprintf(&fields, "    %s %s\n", field.Name.Value, typeNodeToString(field.Type))
+	}
+	return fmt.Sprintf("struct {\n%s}", fields.String())
+}
+
+// symbolType returns the declared type of sym, or the type inferred from its
+// value when it has none.
+func symbolType(sym *Symbol) parser.TypeNode {
+	switch {
+	case sym.Type != nil:
+		return sym.Type
+	case sym.Inferred != nil:
+		return sym.Inferred
+	case sym.Value != nil:
+		return inferExprType(sym.Scope, sym.Value)
+	}
+	return nil
+}
+
+// symbolSignature is the one line declaration of sym, as shown in hovers and
+// completion details.
+func symbolSignature(sym *Symbol) string {
+	typeStr := typeNodeToString(symbolType(sym))
 
 	switch sym.Kind {
 	case SymVar:
-		return fmt.Sprintf("```ayla\negg %s %s\n```", sym.Name, typeStr)
+		return fmt.Sprintf("egg %s %s", sym.Name, typeStr)
 	case SymConst:
-		return fmt.Sprintf("```ayla\nrock %s %s\n```", sym.Name, typeStr)
+		return fmt.Sprintf("rock %s %s", sym.Name, typeStr)
 	case SymFunc:
-		return fmt.Sprintf("```ayla\nfun %s (...)\n```", sym.Name)
+		return funcSignature(sym)
 	case SymParam:
-		return fmt.Sprintf("```ayla\nparam %s %s\n```", sym.Name, typeStr)
+		return fmt.Sprintf("param %s %s", sym.Name, typeStr)
 	case SymStructField:
-		return fmt.Sprintf("```ayla\nfield %s %s\n```", sym.Name, typeStr)
+		name := sym.Name
+		for p := sym.Parent; p != nil; p = p.Parent {
+			name = p.Name + "." + name
+		}
+		return fmt.Sprintf("field %s %s", name, typeStr)
 	case SymType:
-		return fmt.Sprintf("```ayla\ntype %s\n```", sym.Name)
+		return fmt.Sprintf("type %s", sym.Name)
 	case SymUserType:
-		return fmt.Sprintf("```ayla\ntype %s %s\n```", sym.Name, typeStr)
+		return fmt.Sprintf("type %s %s", sym.Name, typeStr)
 	}
 	return sym.Name
 }
 
+func hoverFromSymbol(sym *Symbol) string {
+	signature := symbolSignature(sym)
+
+	if st, ok := sym.Type.(*parser.StructType); ok && sym.Kind == SymUserType {
+		signature = fmt.Sprintf("type %s %s", sym.Name, structTypeString(st))
+	}
+
+	return fmt.Sprintf("```ayla\n%s\n```", signature)
+}
+
 func (s *Server) handleDefinition(req *Request) {
 	var params DefinitionParams
-	json.Unmarshal(req.Params, &params)
+	if !s.decodeParams(req, &params) {
+		return
+	}
 
-	text := s.documents[params.TextDocument.URI]
-	if text == "" {
+	a := s.analysis(params.TextDocument.URI)
+	if a == nil {
 		s.sendResponse(req.ID, nil)
 		return
 	}
 
-	l := lexer.New(text)
-	p := parser.New(l)
-	program := p.ParseProgram()
-	rootScope := BuildSymbols(program)
-
-	ident := findIdentAt(program, params.Position)
+	ident := findIdentAt(a.Program, params.Position)
 	if ident == nil {
 		s.sendResponse(req.ID, nil)
 		return
 	}
 
-	sym := rootScope.Resolve(ident.Value)
+	sym := a.SymbolFor(ident)
 	if sym == nil {
+		s.sendResponse(req.ID, nil)
 		return
 	}
 
-	line, col := sym.Ident.Pos()
-
-	line--
-	col--
+	// builtin types have no declaration to jump to
+	if sym.Ident == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
 
 	loc := Location{
-		URI: params.TextDocument.URI,
-		Range: Range{
-			Start: Position{
-				Line:      line,
-				Character: col,
-			},
-			End: Position{
-				Line:      line,
-				Character: col + len(ident.Value),
-			},
-		},
+		URI:   params.TextDocument.URI,
+		Range: identRange(sym.Ident),
 	}
 
 	s.sendResponse(req.ID, loc)
@@ -332,7 +921,7 @@ func findIdentAt(statements []parser.Statement, pos Position) *parser.Identifier
 }
 
 func walkForIdent(n parser.Node, pos Position) *parser.Identifier {
-	if n == nil {
+	if isNilNode(n) {
 		return nil
 	}
 
@@ -343,37 +932,39 @@ func walkForIdent(n parser.Node, pos Position) *parser.Identifier {
 			return n
 		}
 
+	case *parser.IdentType:
+		if posInsideTok(n.NodeBase.Token, pos) {
+			return &parser.Identifier{NodeBase: n.NodeBase, Value: n.Name}
+		}
+
+	case *parser.ArrayType:
+		return walkForIdent(n.Elem, pos)
+
+	case *parser.MapType:
+		if res := walkForIdent(n.Key, pos); res != nil {
+			return res
+		}
+		return walkForIdent(n.Value, pos)
+
 	case *parser.ExpressionStatement:
 		return walkForIdent(n.Expression, pos)
 
 	case *parser.TypeStatement:
-		switch t := n.Type.(type) {
-
-		case *parser.IdentType:
-			typeName := t.Name
-			return &parser.Identifier{
-				NodeBase: n.NodeBase,
-				Value:    typeName,
-			}
+		if res := walkForIdent(n.Name, pos); res != nil {
+			return res
+		}
+		return walkForIdent(n.Type, pos)
 
-		case *parser.StructType:
-			var fieldNames string
-			for _, field := range t.Fields {
-				if field != nil && field.Name != nil {
-					fieldNames += field.Name.Value + "\n"
-				}
+	case *parser.StructType:
+		for _, field := range n.Fields {
+			if field == nil {
+				continue
 			}
-			typeName := fmt.Sprintf("struct {\n%s}", fieldNames)
-			return &parser.Identifier{
-				NodeBase: n.NodeBase,
-				Value:    typeName,
+			if res := walkForIdent(field.Name, pos); res != nil {
+				return res
 			}
-
-		default:
-			typeName := "unknown"
-			return &parser.Identifier{
-				NodeBase: n.NodeBase,
-				Value:    typeName,
+			if res := walkForIdent(field.Type, pos); res != nil {
+				return res
 			}
 		}
 
@@ -493,6 +1084,38 @@ func walkForIdent(n parser.Node, pos Position) *parser.Identifier {
 			return res
 		}
 
+	case *parser.ParametersClause:
+		if res := walkForIdent(n.Name, pos); res != nil {
+			return res
+		}
+		return walkForIdent(n.Type, pos)
+
+	case *parser.ReturnStatement:
+		for _, value := range n.Values {
+			if res := walkForIdent(value, pos); res != nil {
+				return res
+			}
+		}
+
+	case *parser.GroupedExpression:
+		return walkForIdent(n.Expression, pos)
+
+	case *parser.InterpolatedString:
+		for _, part := range n.Parts {
+			if res := walkForIdent(part, pos); res != nil {
+				return res
+			}
+		}
+
+	case *parser.MemberAssignmentStatement:
+		if res := walkForIdent(n.Object, pos); res != nil {
+			return res
+		}
+		if res := walkForIdent(n.Field, pos); res != nil {
+			return res
+		}
+		return walkForIdent(n.Value, pos)
+
 	case *parser.FuncStatement:
 		if res := walkForIdent(n.Name, pos); res != nil {
 			return res
@@ -575,6 +1198,26 @@ func walkForIdent(n parser.Node, pos Position) *parser.Identifier {
 			}
 		}
 
+	case *parser.ForRangeStatement:
+		if n.Key != nil {
+			if res := walkForIdent(n.Key, pos); res != nil {
+				return res
+			}
+		}
+		if n.Value != nil {
+			if res := walkForIdent(n.Value, pos); res != nil {
+				return res
+			}
+		}
+		if res := walkForIdent(n.Expr, pos); res != nil {
+			return res
+		}
+		for _, stmt := range n.Body {
+			if res := walkForIdent(stmt, pos); res != nil {
+				return res
+			}
+		}
+
 	case *parser.WhileStatement:
 		if res := walkForIdent(n.Condition, pos); res != nil {
 			return res
@@ -584,52 +1227,104 @@ func walkForIdent(n parser.Node, pos Position) *parser.Identifier {
 				return res
 			}
 		}
+
+	case *parser.WithStatement:
+		if res := walkForIdent(n.Expr, pos); res != nil {
+			return res
+		}
+		for _, stmt := range n.Body {
+			if res := walkForIdent(stmt, pos); res != nil {
+				return res
+			}
+		}
+
+	case *parser.SwitchStatement:
+		if res := walkForIdent(n.Value, pos); res != nil {
+			return res
+		}
+		for _, c := range n.Cases {
+			if c == nil {
+				continue
+			}
+			if res := walkForIdent(c.Expr, pos); res != nil {
+				return res
+			}
+			for _, stmt := range c.Body {
+				if res := walkForIdent(stmt, pos); res != nil {
+					return res
+				}
+			}
+		}
+		if n.Default != nil {
+			for _, stmt := range n.Default.Body {
+				if res := walkForIdent(stmt, pos); res != nil {
+					return res
+				}
+			}
+		}
 	}
 
 	return nil
 }
 
 func posInsideTok(tok token.Token, pos Position) bool {
-	// convert token position to 0-based
-	line := tok.Line - 1
-	startCol := tok.Column - 1
-	endCol := startCol
-	startCol = startCol - len(tok.Literal)
+	r := tokenSpan(tok)
 
-	if pos.Line != line {
+	if pos.Line != r.Start.Line {
 		return false
 	}
 
-	return pos.Character >= startCol && pos.Character < endCol
+	return pos.Character >= r.Start.Character && pos.Character < r.End.Character
 }
 
 func tokenRange(pe *parser.ParseError) Range {
-	startCol := pe.Column - 1
-	length := len(pe.Token.Literal)
-	if length == 0 {
-		length = 1
+	r := tokenSpan(pe.Token)
+	r.Start.Line, r.Start.Character = max(r.Start.Line, 0), max(r.Start.Character, 0)
+	if !posBefore(r.Start, r.End) {
+		r.End = Position{Line: r.Start.Line, Character: r.Start.Character + 1}
 	}
+	return r
+}
 
-	return Range{
-		Start: Position{
-			Line:      pe.Line - 1,
-			Character: startCol,
-		},
-		End: Position{
-			Line:      pe.Line - 1,
-			Character: startCol + length,
-		},
+func semanticDiagnostic(uri string, se *SemanticError) Diagnostic {
+	diag := Diagnostic{
+		Range:    identRange(se.Ident),
+		Severity: 1, // Error
+		Code:     se.Code,
+		Message:  se.Message,
+	}
+	if se.Warning {
+		diag.Severity = 2 // Warning
+	}
+
+	if se.Related != nil {
+		diag.RelatedInformation = []DiagnosticRelatedInformation{{
+			Location: Location{URI: uri, Range: identRange(se.Related)},
+			Message:  se.RelatedMessage,
+		}}
 	}
-}
 
-func (s *Server) publishDiagnostics(uri string, text string) {
-	l := lexer.New(text)
-	p := parser.New(l)
-	p.ParseProgram()
+	return diag
+}
 
+func (s *Server) publishDiagnostics(uri string, a *Analysis) {
 	diagnostics := []Diagnostic{}
+	diagnostics = append(diagnostics, parseDiagnostics(a)...)
+	diagnostics = append(diagnostics, semanticDiagnostics(uri, a)...)
+	diagnostics = append(diagnostics, typeDiagnostics(a)...)
+
+	params := map[string]interface{}{
+		"uri":         uri,
+		"diagnostics": diagnostics,
+	}
+
+	s.sendNotification("textDocument/publishDiagnostics", params)
+}
 
-	for _, err := range p.Errors() {
+func parseDiagnostics(a *Analysis) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	for _, err := range a.ParseErrors {
 		pe, ok := err.(*parser.ParseError)
 		if !ok {
 			continue
@@ -642,12 +1337,36 @@ func (s *Server) publishDiagnostics(uri string, text string) {
 		})
 	}
 
-	params := map[string]interface{}{
-		"uri":         uri,
-		"diagnostics": diagnostics,
+	return diagnostics
+}
+
+func semanticDiagnostics(uri string, a *Analysis) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	for _, se := range a.SemanticErrors {
+		diagnostics = append(diagnostics, semanticDiagnostic(uri, se))
 	}
 
-	s.sendNotification("textDocument/publishDiagnostics", params)
+	return diagnostics
+}
+
+func typeDiagnostics(a *Analysis) []Diagnostic {
+	var diagnostics []Diagnostic
+
+	for _, te := range a.TypeErrors {
+		diagnostics = append(diagnostics, typeDiagnostic(te))
+	}
+
+	return diagnostics
+}
+
+func typeDiagnostic(te *TypeError) Diagnostic {
+	return Diagnostic{
+		Range:    te.Range,
+		Severity: 1, // Error
+		Code:     te.Code,
+		Message:  te.Message,
+	}
 }
 
 func (s *Server) sendNotification(method string, params interface{}) {
@@ -658,47 +1377,168 @@ func (s *Server) sendNotification(method string, params interface{}) {
 	}
 
 	data, _ := json.Marshal(msg)
-	writeMessage(s.out, data)
+	s.write(data)
 }
 
-func (s *Server) sendResponse(id *int, result interface{}) {
-	if id == nil {
+func (s *Server) sendResponse(id *RequestID, result interface{}) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		s.sendError(id, InternalError, err.Error())
 		return
 	}
 
-	resp := Response{
+	s.reply(Response{
+		Jsonrpc: "2.0",
+		ID:      id,
+		Result:  data,
+	})
+}
+
+func (s *Server) sendError(id *RequestID, code int, message string) {
+	s.reply(Response{
 		Jsonrpc: "2.0",
 		ID:      id,
-		Result:  result,
+		Error: &ResponseError{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+// reply sends the one response a request is owed. a notification has no id
+// and gets nothing, a second response to the same request is dropped.
+func (s *Server) reply(resp Response) {
+	if resp.ID == nil {
+		return
 	}
 
+	cancelled, pending := s.finish(*resp.ID)
+	if !pending {
+		log.Printf("dropping second response to request %s", resp.ID)
+		return
+	}
+
+	if cancelled && resp.Error == nil {
+		resp.Result = nil
+		resp.Error = &ResponseError{Code: RequestCancelled, Message: "request cancelled"}
+	}
+
+	s.writeResponse(resp)
+}
+
+func (s *Server) writeResponse(resp Response) {
 	data, _ := json.Marshal(resp)
+	s.write(data)
+}
+
+func (s *Server) write(data []byte) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
 	writeMessage(s.out, data)
 }
 
+// readMessage reads one message. it returns io.EOF when the stream ends
+// cleanly between messages. a message whose body is not a valid request is
+// returned as a *ResponseError, the stream can still be read after it.
 func readMessage(r *bufio.Reader) (*Request, error) {
+	contentLength := -1
+	var contentTypeErr error
+
 	// read headers
-	var contentLength int
-	for {
-		line, _ := r.ReadString('\n')
-		if line == "\r\n" {
+	for started := false; ; {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && !started && line == "" {
+			return nil, io.EOF
+		}
+		if err == io.EOF {
+			return nil, fmt.Errorf("reading headers: %w", io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading headers: %w", err)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if !started {
+				continue // stray blank line between messages
+			}
 			break
 		}
-		fmt.Sscanf(line, "Content-Length: %d\r\n", &contentLength)
+		started = true
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed header %q", line)
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "content-length":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid Content-Length %q", value)
+			}
+			contentLength = n
+
+		case "content-type":
+			contentTypeErr = checkContentType(value)
+
+		default:
+			log.Printf("ignoring header %q", line)
+		}
+	}
+
+	if contentLength < 0 {
+		return nil, fmt.Errorf("missing Content-Length header")
 	}
 
 	body := make([]byte, contentLength)
 
 	_, err := io.ReadFull(r, body)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+
+	if contentTypeErr != nil {
+		return nil, &ResponseError{Code: InvalidRequest, Message: contentTypeErr.Error()}
 	}
 
 	var req Request
-	json.Unmarshal(body, &req)
+	if err := json.Unmarshal(body, &req); err != nil {
+		code := ParseError
+		if json.Valid(body) {
+			code = InvalidRequest
+		}
+		return nil, &ResponseError{Code: code, Message: err.Error()}
+	}
 	return &req, nil
 }
 
+// checkContentType accepts the JSON-RPC content types in utf-8, the only
+// encoding the spec allows. "utf8" is still sent by older clients.
+func checkContentType(value string) error {
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return fmt.Errorf("invalid Content-Type %q: %v", value, err)
+	}
+
+	switch mediaType {
+	case "application/vscode-jsonrpc", "application/json":
+	default:
+		return fmt.Errorf("unsupported Content-Type %q", mediaType)
+	}
+
+	switch strings.ToLower(params["charset"]) {
+	case "", "utf-8", "utf8":
+		return nil
+	}
+	return fmt.Errorf("unsupported charset %q", params["charset"])
+}
+
 func writeMessage(w *bufio.Writer, data []byte) {
 	fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(data))
 	w.Write(data)
@@ -715,11 +1555,47 @@ func sameTypeNode(a, b parser.TypeNode) bool {
 		tb, ok := b.(*parser.ArrayType)
 		return ok && sameTypeNode(ta.Elem, tb.Elem)
 
+	case *parser.MapType:
+		tb, ok := b.(*parser.MapType)
+		return ok && sameTypeNode(ta.Key, tb.Key) && sameTypeNode(ta.Value, tb.Value)
+
 	default:
 		return false
 	}
 }
 
+// funcReturns returns the declared return types of fn, or the ones inferred
+// from its return statements when it declares none.
+func funcReturns(fn *Symbol) []parser.TypeNode {
+	if len(fn.Returns) > 0 {
+		return fn.Returns
+	}
+	return fn.InferredReturns
+}
+
+// memberType returns the type of the field m selects.
+func memberType(scope *Scope, m *parser.MemberExpression) parser.TypeNode {
+	if m.Field == nil {
+		return nil
+	}
+
+	var fields map[string]*Symbol
+	if id, ok := m.Left.(*parser.Identifier); ok {
+		sym := scope.Resolve(id.Value)
+		if sym == nil || sym.Kind == SymUserType {
+			return nil
+		}
+		fields = symbolFieldsOf(sym)
+	} else {
+		fields = typeFieldsOf(scope, inferExprType(scope, m.Left), 0)
+	}
+
+	if field, ok := fields[m.Field.Value]; ok {
+		return symbolType(field)
+	}
+	return nil
+}
+
 func isIdent(t parser.TypeNode, name string) bool {
 	id, ok := t.(*parser.IdentType)
 	return ok && id.Name == name
@@ -769,28 +1645,52 @@ func inferExprType(scope *Scope, expr parser.Expression) parser.TypeNode {
 		return &parser.IdentType{Name: e.TypeName.Value}
 
 	case *parser.InfixExpression:
-		left := inferExprType(scope, e.Left)
-		right := inferExprType(scope, e.Right)
+		t, _ := infixType(e.Operator, inferExprType(scope, e.Left), inferExprType(scope, e.Right))
+		return t
+
+	case *parser.PrefixExpression:
+		t, _ := prefixType(e.Operator, inferExprType(scope, e.Right))
+		return t
+
+	case *parser.GroupedExpression:
+		return inferExprType(scope, e.Expression)
+
+	case *parser.InExpression:
+		return &parser.IdentType{Name: "bool"}
 
-		if left == nil || right == nil {
+	case *parser.InterpolatedString:
+		return &parser.IdentType{Name: "string"}
+
+	case *parser.TypeAssertExpression:
+		return e.Type
+
+	case *parser.FuncCall:
+		fn := scope.Resolve(e.Name.Value)
+		if fn == nil || fn.Kind != SymFunc {
 			return nil
 		}
 
-		// same types → same result
-		if sameTypeNode(left, right) {
-			return left
+		// a call giving back several values has no single type
+		if returns := funcReturns(fn); len(returns) == 1 {
+			return returns[0]
 		}
+		return nil
 
-		// int + float => float
-		if isIdent(left, "int") && isIdent(right, "float") ||
-			isIdent(left, "float") && isIdent(right, "int") {
-			return &parser.IdentType{Name: "float"}
+	case *parser.IndexExpression:
+		switch t := inferExprType(scope, e.Left).(type) {
+		case *parser.ArrayType:
+			return t.Elem
+		case *parser.MapType:
+			return t.Value
+		case *parser.IdentType:
+			if t.Name == "string" {
+				return t
+			}
 		}
-
 		return nil
 
-	case *parser.PrefixExpression:
-		return inferExprType(scope, e.Right)
+	case *parser.MemberExpression:
+		return memberType(scope, e)
 
 	case *parser.Identifier:
 		sym := scope.Resolve(e.Value)
@@ -798,7 +1698,10 @@ func inferExprType(scope *Scope, expr parser.Expression) parser.TypeNode {
 			return nil
 		}
 
-		return sym.Type
+		if sym.Type != nil {
+			return sym.Type
+		}
+		return sym.Inferred
 	}
 
 	return nil
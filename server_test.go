@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// frame wraps body in a Content-Length header, after any extra headers.
+func frame(body string, headers ...string) string {
+	return fmt.Sprintf("%sContent-Length: %d\r\n\r\n%s", strings.Join(headers, ""), len(body), body)
+}
+
+func TestReadMessage(t *testing.T) {
+	const body = `{"jsonrpc":"2.0","id":1,"method":"shutdown"}`
+
+	tests := []struct {
+		name     string
+		input    string
+		wantID   *RequestID
+		wantCode int  // a *ResponseError with this code, when not 0
+		wantErr  bool // any other error
+	}{
+		{
+			name:   "int id",
+			input:  frame(body),
+			wantID: &RequestID{Num: 1},
+		},
+		{
+			name:   "string id",
+			input:  frame(`{"jsonrpc":"2.0","id":"a","method":"shutdown"}`),
+			wantID: &RequestID{Str: "a", IsString: true},
+		},
+		{
+			name:  "notification",
+			input: frame(`{"jsonrpc":"2.0","method":"initialized"}`),
+		},
+		{
+			name:   "lower case header",
+			input:  fmt.Sprintf("content-length: %d\r\n\r\n%s", len(body), body),
+			wantID: &RequestID{Num: 1},
+		},
+		{
+			name:   "blank lines between messages",
+			input:  "\r\n\r\n" + frame(body),
+			wantID: &RequestID{Num: 1},
+		},
+		{
+			name:   "utf-8 content type",
+			input:  frame(body, "Content-Type: application/vscode-jsonrpc; charset=utf-8\r\n"),
+			wantID: &RequestID{Num: 1},
+		},
+		{
+			name:   "utf8 content type",
+			input:  frame(body, "content-type: application/vscode-jsonrpc; charset=UTF8\r\n"),
+			wantID: &RequestID{Num: 1},
+		},
+		{
+			name:     "utf-16 content type",
+			input:    frame(body, "Content-Type: application/vscode-jsonrpc; charset=utf-16\r\n"),
+			wantCode: InvalidRequest,
+		},
+		{
+			name:     "other content type",
+			input:    frame(body, "Content-Type: text/plain\r\n"),
+			wantCode: InvalidRequest,
+		},
+		{
+			name:    "negative length",
+			input:   "Content-Length: -1\r\n\r\n" + body,
+			wantErr: true,
+		},
+		{
+			name:    "invalid length",
+			input:   "Content-Length: abc\r\n\r\n" + body,
+			wantErr: true,
+		},
+		{
+			name:    "missing length",
+			input:   "Content-Type: application/json\r\n\r\n" + body,
+			wantErr: true,
+		},
+		{
+			name:    "malformed header",
+			input:   "Content-Length 10\r\n\r\n" + body,
+			wantErr: true,
+		},
+		{
+			name:    "short body",
+			input:   fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body)+10, body),
+			wantErr: true,
+		},
+		{
+			name:    "headers cut off",
+			input:   "Content-Length: 10\r\n",
+			wantErr: true,
+		},
+		{
+			name:     "malformed json",
+			input:    frame(`{"jsonrpc":"2.0",`),
+			wantCode: ParseError,
+		},
+		{
+			name:     "object id",
+			input:    frame(`{"jsonrpc":"2.0","id":{},"method":"shutdown"}`),
+			wantCode: InvalidRequest,
+		},
+		{
+			name:     "not an object",
+			input:    frame(`[1,2]`),
+			wantCode: InvalidRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := readMessage(bufio.NewReader(bytes.NewBufferString(tt.input)))
+
+			var rerr *ResponseError
+			switch {
+			case tt.wantCode != 0:
+				if !errors.As(err, &rerr) || rerr.Code != tt.wantCode {
+					t.Fatalf("error %v, want code %d", err, tt.wantCode)
+				}
+				return
+			case tt.wantErr:
+				if err == nil || errors.As(err, &rerr) || err == io.EOF {
+					t.Fatalf("error %v, want a read error", err)
+				}
+				return
+			case err != nil:
+				t.Fatalf("readMessage: %v", err)
+			}
+
+			switch {
+			case tt.wantID == nil && req.ID != nil:
+				t.Errorf("id %v, want none", *req.ID)
+			case tt.wantID != nil && (req.ID == nil || *req.ID != *tt.wantID):
+				t.Errorf("id %v, want %v", req.ID, *tt.wantID)
+			}
+		})
+	}
+}
+
+// TestReadMessageStream checks messages are read back to back and the stream
+// can still be read after one that is not a valid request.
+func TestReadMessageStream(t *testing.T) {
+	input := frame(`{"jsonrpc":"2.0","id":1,"method":"a"}`) +
+		frame(`{"jsonrpc":`) +
+		frame(`{"jsonrpc":"2.0","id":2,"method":"b"}`)
+	r := bufio.NewReader(bytes.NewBufferString(input))
+
+	var methods []string
+	for {
+		req, err := readMessage(r)
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*ResponseError); ok {
+			methods = append(methods, "error")
+			continue
+		}
+		if err != nil {
+			t.Fatalf("readMessage: %v", err)
+		}
+		methods = append(methods, req.Method)
+	}
+
+	if got := strings.Join(methods, " "); got != "a error b" {
+		t.Errorf("read %q, want %q", got, "a error b")
+	}
+}
+
+// TestInvalidRequestReplies runs the server over a stream of bad messages
+// and checks each one that can be answered gets an error response.
+func TestInvalidRequestReplies(t *testing.T) {
+	input := frame(`{"jsonrpc":"1.0","id":1,"method":"initialize"}`) +
+		frame(`{"jsonrpc":"2.0","id":"b"}`) +
+		frame(`{"jsonrpc":"2.0","method":""}`) + // no id, so no reply
+		frame(`{"jsonrpc":"2.0","id":3,"method":"initialize"}`, "Content-Type: application/json; charset=latin1\r\n") +
+		frame(`{"jsonrpc":"2.0","id":4,`) +
+		frame(`{"jsonrpc":"2.0","method":"exit"}`)
+
+	var out bytes.Buffer
+	if code := NewServer(bytes.NewBufferString(input), &out).Run(); code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+
+	want := []struct {
+		id   string
+		code int
+	}{
+		{"1", InvalidRequest},
+		{`"b"`, InvalidRequest},
+		{"null", InvalidRequest},
+		{"null", ParseError},
+	}
+
+	r := bufio.NewReader(&out)
+	for i, w := range want {
+		resp, err := readMessage(r)
+		if err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+
+		id := "null"
+		if resp.ID != nil {
+			data, _ := resp.ID.MarshalJSON()
+			id = string(data)
+		}
+		if id != w.id || resp.Error == nil || resp.Error.Code != w.code {
+			t.Errorf("response %d: id %s error %+v, want id %s code %d", i, id, resp.Error, w.id, w.code)
+		}
+	}
+
+	if _, err := readMessage(r); err != io.EOF {
+		t.Errorf("more responses than expected: %v", err)
+	}
+}
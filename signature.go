@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/z-sk1/ayla-lang/token"
+)
+
+type SignatureHelpParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position Position `json:"position"`
+}
+
+type SignatureHelp struct {
+	Signatures      []SignatureInformation `json:"signatures"`
+	ActiveSignature int                    `json:"activeSignature"`
+	ActiveParameter int                    `json:"activeParameter"`
+}
+
+type SignatureInformation struct {
+	Label      string                 `json:"label"`
+	Parameters []ParameterInformation `json:"parameters"`
+}
+
+type ParameterInformation struct {
+	// Label is the [start, end) offsets of the param in the signature label
+	Label [2]int `json:"label"`
+}
+
+func (s *Server) handleSignatureHelp(req *Request) {
+	var params SignatureHelpParams
+	if !s.decodeParams(req, &params) {
+		return
+	}
+
+	a := s.analysis(params.TextDocument.URI)
+	if a == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	site, ok := callAt(a.Tokens, params.Position)
+	if !ok {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	fn := a.callee(site)
+	if fn == nil {
+		s.sendResponse(req.ID, nil)
+		return
+	}
+
+	info := SignatureInformation{
+		Label:      funcSignature(fn),
+		Parameters: []ParameterInformation{},
+	}
+
+	// params are found in the label in order, after the opening paren
+	offset := len("fun " + fn.Name + "(")
+	for i := range fn.Params {
+		param := paramString(fn, i)
+		start := offset + strings.Index(info.Label[offset:], param)
+		info.Parameters = append(info.Parameters, ParameterInformation{
+			Label: [2]int{start, start + len(param)},
+		})
+		offset = start + len(param)
+	}
+
+	// past the last param nothing is active, the spec treats an out of
+	// range index that way
+	active := activeParam(fn, site.Arg)
+	if active < 0 {
+		active = len(fn.Params)
+	}
+
+	s.sendResponse(req.ID, SignatureHelp{
+		Signatures:      []SignatureInformation{info},
+		ActiveParameter: active,
+	})
+}
+
+// funcSignature renders fn the way it is declared, such as
+// fun add(a int, b int) (int).
+func funcSignature(fn *Symbol) string {
+	params := make([]string, len(fn.Params))
+	for i := range fn.Params {
+		params[i] = paramString(fn, i)
+	}
+
+	sig := fmt.Sprintf("fun %s(%s)", fn.Name, strings.Join(params, ", "))
+
+	if len(fn.Returns) > 0 {
+		returns := make([]string, len(fn.Returns))
+		for i, ret := range fn.Returns {
+			returns[i] = typeNodeToString(ret)
+		}
+		sig += fmt.Sprintf(" (%s)", strings.Join(returns, ", "))
+	}
+
+	return sig
+}
+
+// paramString renders param i of fn. untyped params are shown bare.
+func paramString(fn *Symbol, i int) string {
+	param := fn.Params[i]
+	if param.Type == nil {
+		return param.Name
+	}
+
+	typeStr := typeNodeToString(param.Type)
+	if fn.Variadic && i == len(fn.Params)-1 {
+		typeStr = "..." + typeStr
+	}
+	return param.Name + " " + typeStr
+}
+
+// activeParam maps argument arg of a call to fn onto the index of the param
+// it fills, or -1 when fn takes fewer arguments.
+func activeParam(fn *Symbol, arg int) int {
+	n := len(fn.Params)
+	switch {
+	case arg < n:
+		return arg
+	case fn.Variadic && n > 0:
+		return n - 1
+	}
+	return -1
+}
+
+// callSite is a call whose argument list surrounds a position.
+type callSite struct {
+	Name token.Token // the callee's name
+	Arg  int         // index of the argument the position is in
+}
+
+// callAt finds the innermost call whose parens surround pos. it works on
+// tokens rather than the tree so a call that is still being typed, and so
+// does not parse, is found as well.
+func callAt(toks []token.Token, pos Position) (callSite, bool) {
+	end := 0
+	for end < len(toks) && toks[end].Type != token.EOF && posBefore(tokenSpan(toks[end]).Start, pos) {
+		end++
+	}
+
+	depth := 0
+	arg := 0
+
+	for i := end - 1; i >= 0; i-- {
+		tok := toks[i]
+
+		switch tok.Type {
+		case token.NEWLINE:
+			// args cannot span lines, only brackets closed before pos can
+			if depth == 0 {
+				return callSite{}, false
+			}
+
+		case token.RPAREN, token.RBRACKET, token.RBRACE:
+			depth++
+
+		case token.COMMA:
+			if depth == 0 {
+				arg++
+			}
+
+		case token.LPAREN, token.LBRACKET, token.LBRACE:
+			if depth > 0 {
+				depth--
+				continue
+			}
+
+			prev := prevToken(toks, i)
+			if tok.Type == token.LPAREN && prev >= 0 && toks[prev].Type == token.IDENT {
+				// the param list of a declaration is not a call
+				if before := prevToken(toks, prev); before >= 0 && toks[before].Type == token.FUNC {
+					return callSite{}, false
+				}
+				return callSite{Name: toks[prev], Arg: arg}, true
+			}
+
+			// a block ends the search, but a struct literal is part of an
+			// argument
+			if tok.Type == token.LBRACE && (prev < 0 || toks[prev].Type != token.IDENT) {
+				return callSite{}, false
+			}
+
+			// the commas seen so far belong to the nested brackets
+			arg = 0
+		}
+	}
+
+	return callSite{}, false
+}
+
+// prevToken returns the index of the last token before i that is not a
+// newline, or -1.
+func prevToken(toks []token.Token, i int) int {
+	for i--; i >= 0; i-- {
+		if toks[i].Type != token.NEWLINE {
+			return i
+		}
+	}
+	return -1
+}
+
+// callee returns the function called at site, or nil.
+func (a *Analysis) callee(site callSite) *Symbol {
+	sym := a.symbols[site.Name]
+
+	// a call that did not parse was never resolved
+	if sym == nil {
+		sym = a.Root.ScopeAt(tokenSpan(site.Name).Start).Resolve(site.Name.Literal)
+	}
+
+	if sym == nil || sym.Kind != SymFunc {
+		return nil
+	}
+	return sym
+}
+
+// callHover is the hover for a call to fn with the cursor in argument arg.
+func callHover(fn *Symbol, arg int) string {
+	text := fmt.Sprintf("```ayla\n%s\n```", funcSignature(fn))
+
+	if p := activeParam(fn, arg); p >= 0 {
+		text += fmt.Sprintf("\n\nargument %d is **`%s`**", arg+1, paramString(fn, p))
+	} else {
+		text += fmt.Sprintf("\n\nargument %d is extra, %s takes %d", arg+1, fn.Name, len(fn.Params))
+	}
+
+	return text
+}
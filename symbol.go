@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"sort"
+	"strings"
 
 	"github.com/z-sk1/ayla-lang/parser"
+	"github.com/z-sk1/ayla-lang/token"
 )
 
 type SymbolKind int
@@ -20,31 +22,108 @@ const (
 )
 
 type Symbol struct {
-	Kind   SymbolKind
-	Name   string
-	Ident  *parser.Identifier // where it is declared
-	Type   parser.TypeNode
-	Value  parser.Expression
-	Parent *Symbol // optional (struct, function)
+	Kind  SymbolKind
+	Name  string
+	Ident *parser.Identifier // where it is declared
+	Type  parser.TypeNode
+	Value parser.Expression
+
+	// Inferred is the type of Value when no Type is declared, filled in
+	// once the document is analyzed.
+	Inferred parser.TypeNode
+
+	// Params and Returns make up the signature of a function. a variadic
+	// function takes any number of arguments for its last param.
+	Params   []*Symbol
+	Returns  []parser.TypeNode
+	Variadic bool
+
+	// InferredReturns are the types a function without declared returns
+	// gives back, filled in once the document is analyzed.
+	InferredReturns []parser.TypeNode
+
+	// Fields holds the struct fields of a symbol whose declared type is a
+	// struct, keyed by name.
+	Fields map[string]*Symbol
+
+	Parent *Symbol     // optional (struct, function)
+	Scope  *Scope      // scope it is declared in
+	Decl   parser.Node // statement or param that declares it
+
+	Refs []*parser.Identifier // every use that resolves to it
 }
 
 type Scope struct {
-	Parent  *Scope
-	Symbols map[string]*Symbol
+	Parent   *Scope
+	Children []*Scope
+	Symbols  map[string]*Symbol
+
+	// Span is the source range the scope covers. it is unset for the root
+	// scope, which covers the whole document.
+	Span Range
+
+	// Owner is the function whose params and body live in this scope.
+	Owner *Symbol
 }
 
 func NewScope(parent *Scope) *Scope {
-	return &Scope{
+	scope := &Scope{
 		Parent:  parent,
 		Symbols: make(map[string]*Symbol),
 	}
+
+	if parent != nil {
+		parent.Children = append(parent.Children, scope)
+	}
+
+	return scope
+}
+
+// SemanticError is a problem found while building or checking symbols,
+// reported at the identifier it concerns.
+type SemanticError struct {
+	Message string
+	Ident   *parser.Identifier
+
+	// Code names the kind of problem for the errors quick fixes exist
+	// for. Warning marks a problem the program still runs with.
+	Code    string
+	Warning bool
+
+	// Related optionally points at another identifier involved in the
+	// error, such as the first declaration of a redeclared name.
+	Related        *parser.Identifier
+	RelatedMessage string
 }
 
-func (s *Scope) Define(sym *Symbol) {
-	if _, exists := s.Symbols[sym.Name]; exists {
-		panic(fmt.Sprintf("redeclaration of %s", sym.Name))
+// codes of the diagnostics quick fixes are offered for
+const (
+	codeUndefined    = "undefined"
+	codeConstAssign  = "const-assign"
+	codeUnused       = "unused"
+	codeMissingField = "missing-field"
+	codeArgCount     = "arg-count"
+)
+
+func (e *SemanticError) Error() string {
+	line, col := e.Ident.Pos()
+	return fmt.Sprintf("semantic error at %d:%d: %s", line, col, e.Message)
+}
+
+// Define adds sym to the scope. a name that is already declared in the same
+// scope is left bound to its first declaration and reported as an error.
+func (s *Scope) Define(sym *Symbol) *SemanticError {
+	if prev, exists := s.Symbols[sym.Name]; exists {
+		return &SemanticError{
+			Message:        fmt.Sprintf("redeclaration of %s", sym.Name),
+			Ident:          sym.Ident,
+			Related:        prev.Ident,
+			RelatedMessage: fmt.Sprintf("%s first declared here", sym.Name),
+		}
 	}
+	sym.Scope = s
 	s.Symbols[sym.Name] = sym
+	return nil
 }
 
 func (s *Scope) Resolve(name string) *Symbol {
@@ -56,33 +135,542 @@ func (s *Scope) Resolve(name string) *Symbol {
 	return nil
 }
 
-func BuildSymbols(stmts []parser.Statement) *Scope {
-	root := NewScope(nil)
+// ScopeAt returns the innermost scope whose span contains pos.
+func (s *Scope) ScopeAt(pos Position) *Scope {
+	for _, child := range s.Children {
+		if rangeContains(child.Span, pos) {
+			return child.ScopeAt(pos)
+		}
+	}
+	return s
+}
+
+// indexSymbols maps the token of every identifier that declares or refers
+// to a symbol in the tree s belongs to onto that symbol, fields included.
+// identifiers are matched by their token so copies made for type names are
+// found as well.
+func indexSymbols(s *Scope) map[token.Token]*Symbol {
+	top := s
+	for top.Parent != nil {
+		top = top.Parent
+	}
+
+	index := make(map[token.Token]*Symbol)
 
-	for _, t := range []string{"int", "float", "string", "bool", "arr"} {
-		root.Define(&Symbol{
+	var collect func(sym *Symbol)
+	collect = func(sym *Symbol) {
+		if sym.Ident != nil {
+			index[sym.Ident.Token] = sym
+		}
+		for _, ref := range sym.Refs {
+			index[ref.Token] = sym
+		}
+		for _, field := range sym.Fields {
+			collect(field)
+		}
+	}
+
+	var walk func(sc *Scope)
+	walk = func(sc *Scope) {
+		for _, sym := range sc.Symbols {
+			collect(sym)
+		}
+		for _, child := range sc.Children {
+			walk(child)
+		}
+	}
+	walk(top)
+
+	return index
+}
+
+// builtinFunc is the signature of a function the ayla interpreter provides.
+// params are written "name type".
+type builtinFunc struct {
+	name     string
+	params   []string
+	returns  []string
+	variadic bool
+}
+
+// builtinFuncs are the functions the ayla interpreter provides.
+var builtinFuncs = []builtinFunc{
+	{name: "toInt", params: []string{"v thing"}, returns: []string{"int"}},
+	{name: "toFloat", params: []string{"v thing"}, returns: []string{"float"}},
+	{name: "toString", params: []string{"v thing"}, returns: []string{"string"}},
+	{name: "toBool", params: []string{"v thing"}, returns: []string{"bool"}},
+	{name: "toArr", params: []string{"values thing"}, returns: []string{"arr"}, variadic: true},
+	{name: "ord", params: []string{"c string"}, returns: []string{"int"}},
+	{name: "chr", params: []string{"code int"}, returns: []string{"string"}},
+	{name: "len", params: []string{"v thing"}, returns: []string{"int"}},
+	{name: "typeof", params: []string{"v thing"}, returns: []string{"string"}},
+	{name: "explode", params: []string{"values thing"}, variadic: true},
+	{name: "explodeln", params: []string{"values thing"}, variadic: true},
+	{name: "scanln", params: []string{"target string"}},
+	{name: "scankey", params: []string{"target thing"}},
+	{name: "push", params: []string{"array arr", "value thing"}},
+	{name: "pop", params: []string{"array arr"}, returns: []string{"thing"}},
+	{name: "insert", params: []string{"array arr", "index int", "value thing"}},
+	{name: "remove", params: []string{"array arr", "index int"}, returns: []string{"thing"}},
+	{name: "clear", params: []string{"array arr"}},
+	{name: "wait", params: []string{"ms int"}},
+	{name: "randi", params: []string{"bounds int"}, returns: []string{"int"}, variadic: true},
+	{name: "randf", params: []string{"bounds float"}, returns: []string{"float"}, variadic: true},
+	{name: "sin", params: []string{"x float"}, returns: []string{"float"}},
+	{name: "cos", params: []string{"x float"}, returns: []string{"float"}},
+}
+
+// symbol builds the symbol of a builtin function. its params have no
+// declaration either.
+func (f builtinFunc) symbol() *Symbol {
+	fn := &Symbol{
+		Kind:     SymFunc,
+		Name:     f.name,
+		Variadic: f.variadic,
+	}
+
+	for _, param := range f.params {
+		name, typ, _ := strings.Cut(param, " ")
+		fn.Params = append(fn.Params, &Symbol{
+			Kind:   SymParam,
+			Name:   name,
+			Type:   &parser.IdentType{Name: typ},
+			Parent: fn,
+		})
+	}
+	for _, typ := range f.returns {
+		fn.Returns = append(fn.Returns, &parser.IdentType{Name: typ})
+	}
+
+	return fn
+}
+
+type symbolBuilder struct {
+	toks   []token.Token
+	errors []*SemanticError
+
+	// index finds a token in toks, built on first use
+	index map[token.Token]int
+
+	// function bodies are built once the flow that declares them is done,
+	// since a call can only run them after that point
+	pending []func()
+}
+
+// BuildSymbols builds the scope tree for a program and resolves every
+// reference in it. toks are the tokens of the same source and are used to
+// give every block scope its span. the returned root scope is the file
+// scope, builtins live in its parent so a program may shadow them.
+func BuildSymbols(stmts []parser.Statement, toks []token.Token) (*Scope, []*SemanticError) {
+	universe := NewScope(nil)
+
+	for _, t := range []string{"int", "float", "string", "bool", "arr", "thing"} {
+		universe.Define(&Symbol{
 			Kind: SymType,
 			Name: t,
 		})
 	}
 
-	buildInScope(root, stmts)
-	return root
+	for _, f := range builtinFuncs {
+		universe.Define(f.symbol())
+	}
+
+	root := NewScope(universe)
+
+	b := &symbolBuilder{toks: toks}
+	b.buildInScope(root, stmts)
+
+	for len(b.pending) > 0 {
+		next := b.pending[0]
+		b.pending = b.pending[1:]
+		next()
+	}
+
+	b.reportUnused(root)
+
+	return root, b.errors
+}
+
+func (b *symbolBuilder) define(scope *Scope, sym *Symbol) {
+	if err := scope.Define(sym); err != nil {
+		b.errors = append(b.errors, err)
+	}
+
+	if st, ok := sym.Type.(*parser.StructType); ok {
+		b.defineFields(scope, sym, st)
+	} else if lit, ok := sym.Value.(*parser.AnonymousStructLiteral); ok && sym.Type == nil {
+		b.defineValueFields(scope, sym, lit)
+	}
+}
+
+// defineFields gives sym a symbol for every field of its struct type st.
+// fields of nested struct types hang off their own field.
+func (b *symbolBuilder) defineFields(scope *Scope, sym *Symbol, st *parser.StructType) {
+	sym.Fields = make(map[string]*Symbol)
+
+	for _, field := range st.Fields {
+		if field == nil || field.Name == nil {
+			continue
+		}
+
+		if prev, exists := sym.Fields[field.Name.Value]; exists {
+			b.errors = append(b.errors, &SemanticError{
+				Message:        fmt.Sprintf("duplicate field %s", field.Name.Value),
+				Ident:          field.Name,
+				Related:        prev.Ident,
+				RelatedMessage: fmt.Sprintf("%s first declared here", field.Name.Value),
+			})
+			continue
+		}
+
+		fieldSym := &Symbol{
+			Kind:   SymStructField,
+			Name:   field.Name.Value,
+			Ident:  field.Name,
+			Type:   field.Type,
+			Parent: sym,
+			Scope:  scope,
+			Decl:   sym.Decl,
+		}
+		sym.Fields[fieldSym.Name] = fieldSym
+
+		if nested, ok := field.Type.(*parser.StructType); ok {
+			b.defineFields(scope, fieldSym, nested)
+		}
+	}
+}
+
+// defineValueFields gives sym a symbol for every field of the anonymous
+// struct lit it holds. those fields are only named in the literal, so they
+// have no identifier to point at.
+func (b *symbolBuilder) defineValueFields(scope *Scope, sym *Symbol, lit *parser.AnonymousStructLiteral) {
+	sym.Fields = make(map[string]*Symbol)
+
+	for _, name := range sortedKeys(lit.Fields) {
+		fieldSym := &Symbol{
+			Kind:   SymStructField,
+			Name:   name,
+			Value:  lit.Fields[name],
+			Parent: sym,
+			Scope:  scope,
+			Decl:   sym.Decl,
+		}
+		sym.Fields[name] = fieldSym
+
+		if nested, ok := fieldSym.Value.(*parser.AnonymousStructLiteral); ok {
+			b.defineValueFields(scope, fieldSym, nested)
+		}
+	}
+}
+
+// fieldsOf returns the fields of the value expr evaluates to, or nil when
+// its type is not known to be a struct.
+func (b *symbolBuilder) fieldsOf(scope *Scope, expr parser.Expression) map[string]*Symbol {
+	switch e := expr.(type) {
+	case *parser.Identifier:
+		if sym := scope.Resolve(e.Value); sym != nil && sym.Kind != SymUserType {
+			return symbolFieldsOf(sym)
+		}
+
+	case *parser.MemberExpression:
+		if field := b.memberField(scope, e); field != nil {
+			return symbolFieldsOf(field)
+		}
+
+	case *parser.GroupedExpression:
+		return b.fieldsOf(scope, e.Expression)
+
+	default:
+		return typeFieldsOf(scope, inferExprType(scope, expr), 0)
+	}
+	return nil
+}
+
+// symbolFieldsOf returns the fields of a value symbol, through its named
+// type if it has one.
+func symbolFieldsOf(sym *Symbol) map[string]*Symbol {
+	if sym.Fields != nil {
+		return sym.Fields
+	}
+	return typeFieldsOf(sym.Scope, symbolType(sym), 0)
+}
+
+// typeFieldsOf returns the fields of the named struct type t.
+func typeFieldsOf(scope *Scope, t parser.TypeNode, depth int) map[string]*Symbol {
+	// guards against types defined in terms of each other
+	if depth > 8 || scope == nil {
+		return nil
+	}
+
+	id, ok := t.(*parser.IdentType)
+	if !ok {
+		return nil
+	}
+
+	sym := scope.Resolve(id.Name)
+	if sym == nil || sym.Kind != SymUserType {
+		return nil
+	}
+	if sym.Fields != nil {
+		return sym.Fields
+	}
+	return typeFieldsOf(sym.Scope, sym.Type, depth+1)
+}
+
+// memberField resolves the field m selects, or returns nil when the type of
+// its left side is unknown. a field missing from a known struct is reported.
+func (b *symbolBuilder) memberField(scope *Scope, m *parser.MemberExpression) *Symbol {
+	if m.Field == nil {
+		return nil
+	}
+
+	fields := b.fieldsOf(scope, m.Left)
+	if fields == nil {
+		return nil
+	}
+
+	field, ok := fields[m.Field.Value]
+	if !ok {
+		b.errors = append(b.errors, &SemanticError{
+			Message: fmt.Sprintf("unknown field: %s", m.Field.Value),
+			Ident:   m.Field,
+		})
+		return nil
+	}
+	return field
+}
+
+// resolveMember resolves the field of m and records the use.
+func (b *symbolBuilder) resolveMember(scope *Scope, m *parser.MemberExpression) {
+	if field := b.memberField(scope, m); field != nil {
+		field.Refs = append(field.Refs, m.Field)
+	}
+}
+
+// resolveLiteralKeys links the field names written in a struct literal to
+// the fields of its type. the parser keeps only their names, so they are
+// found in the tokens following the type name. fields left out are
+// reported, reading them fails at run time.
+func (b *symbolBuilder) resolveLiteralKeys(scope *Scope, lit *parser.StructLiteral) {
+	if lit.TypeName == nil {
+		return
+	}
+
+	fields := typeFieldsOf(scope, &parser.IdentType{Name: lit.TypeName.Value}, 0)
+	if fields == nil {
+		return
+	}
+
+	if b.index == nil {
+		b.index = make(map[token.Token]int, len(b.toks))
+		for i, tok := range b.toks {
+			b.index[tok] = i
+		}
+	}
+
+	i, ok := b.index[lit.TypeName.Token]
+	if !ok {
+		return
+	}
+
+	written := make(map[string]bool)
+	closed := false
+
+	depth := 0
+	for j := i + 1; j+1 < len(b.toks); j++ {
+		tok := b.toks[j]
+
+		switch tok.Type {
+		case token.LPAREN, token.LBRACKET, token.LBRACE:
+			depth++
+		case token.RPAREN, token.RBRACKET, token.RBRACE:
+			depth--
+		}
+		if tok.Type == token.EOF {
+			break
+		}
+		if depth == 0 {
+			closed = true
+			break
+		}
+
+		if depth != 1 || tok.Type != token.IDENT || b.toks[j+1].Type != token.COLON {
+			continue
+		}
+
+		key := &parser.Identifier{NodeBase: parser.NodeBase{Token: tok}, Value: tok.Literal}
+		written[key.Value] = true
+		if field, ok := fields[key.Value]; ok {
+			field.Refs = append(field.Refs, key)
+		} else {
+			b.errors = append(b.errors, &SemanticError{
+				Message: fmt.Sprintf("unknown field: %s", key.Value),
+				Ident:   key,
+			})
+		}
+	}
+
+	// a literal cut short by a syntax error is missing nothing yet
+	if !closed {
+		return
+	}
+
+	var missing []*Symbol
+	for name, field := range fields {
+		if !written[name] && field.Ident != nil {
+			missing = append(missing, field)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		return posBefore(identRange(missing[i].Ident).Start, identRange(missing[j].Ident).Start)
+	})
+
+	for _, field := range missing {
+		b.errors = append(b.errors, &SemanticError{
+			Message:        fmt.Sprintf("missing field %s in %s literal", field.Name, lit.TypeName.Value),
+			Ident:          lit.TypeName,
+			Code:           codeMissingField,
+			Warning:        true,
+			Related:        field.Ident,
+			RelatedMessage: fmt.Sprintf("%s declared here", field.Name),
+		})
+	}
+}
+
+// resolve looks ident up from scope. names are only visible once the
+// statement declaring them has run, which is the point the builder has
+// reached, so anything not defined yet is reported with msg and code. a
+// resolved use is recorded on its symbol.
+func (b *symbolBuilder) resolve(scope *Scope, ident *parser.Identifier, msg, code string) *Symbol {
+	if ident == nil || ident.Value == "_" {
+		return nil
+	}
+
+	sym := scope.Resolve(ident.Value)
+	if sym == nil {
+		b.errors = append(b.errors, &SemanticError{
+			Message: fmt.Sprintf("%s: %s", msg, ident.Value),
+			Ident:   ident,
+			Code:    code,
+		})
+		return nil
+	}
+
+	sym.Refs = append(sym.Refs, ident)
+	return sym
+}
+
+// resolveAssigned resolves the name an assignment stores to, which must
+// not be a const.
+func (b *symbolBuilder) resolveAssigned(scope *Scope, ident *parser.Identifier) {
+	sym := b.resolve(scope, ident, "assignment to undefined variable", codeUndefined)
+	if sym == nil || sym.Kind != SymConst {
+		return
+	}
+
+	err := &SemanticError{
+		Message: fmt.Sprintf("cannot reassign to const: %s", ident.Value),
+		Ident:   ident,
+		Code:    codeConstAssign,
+	}
+	if sym.Ident != nil {
+		err.Related = sym.Ident
+		err.RelatedMessage = fmt.Sprintf("%s declared here", sym.Name)
+	}
+	b.errors = append(b.errors, err)
 }
 
-func buildInScope(scope *Scope, stmts []parser.Statement) {
-	log.Printf("ENTER scope %p\n", scope)
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf(
-				"buildInScope panic (scope=%p): %#v",
-				scope, r,
-			)
+// reportUnused reports the variables declared in scope and the scopes in it
+// that are never used. like other uses, assignments count.
+func (b *symbolBuilder) reportUnused(scope *Scope) {
+	var unused []*Symbol
+
+	var walk func(sc *Scope)
+	walk = func(sc *Scope) {
+		for _, sym := range sc.Symbols {
+			if sym.Kind != SymVar || sym.Ident == nil || sym.Name == "_" || len(sym.Refs) > 0 {
+				continue
+			}
+
+			switch sym.Decl.(type) {
+			case *parser.VarStatement, *parser.VarStatementNoKeyword,
+				*parser.MultiVarStatement, *parser.MultiVarStatementNoKeyword:
+				unused = append(unused, sym)
+			}
+		}
+		for _, child := range sc.Children {
+			walk(child)
 		}
-	}()
+	}
+	walk(scope)
+
+	sort.Slice(unused, func(i, j int) bool {
+		return posBefore(identRange(unused[i].Ident).Start, identRange(unused[j].Ident).Start)
+	})
+
+	for _, sym := range unused {
+		b.errors = append(b.errors, &SemanticError{
+			Message: fmt.Sprintf("unused variable: %s", sym.Name),
+			Ident:   sym.Ident,
+			Code:    codeUnused,
+			Warning: true,
+		})
+	}
+}
+
+// resolveRefs resolves every reference in an expression or type node.
+func (b *symbolBuilder) resolveRefs(scope *Scope, n parser.Node) {
+	inspect(n, func(n parser.Node) bool {
+		switch n := n.(type) {
+		case *parser.Identifier:
+			b.resolve(scope, n, "undefined variable", codeUndefined)
+
+		case *parser.FuncCall:
+			b.resolve(scope, n.Name, "unknown function", "")
+			for _, arg := range n.Args {
+				b.resolveRefs(scope, arg)
+			}
+			return false
+
+		case *parser.StructLiteral:
+			b.resolve(scope, n.TypeName, "unknown type", "")
+			b.resolveLiteralKeys(scope, n)
+			for _, name := range sortedKeys(n.Fields) {
+				b.resolveRefs(scope, n.Fields[name])
+			}
+			return false
+
+		case *parser.MemberExpression:
+			// the field belongs to the value, not to the scope
+			b.resolveRefs(scope, n.Left)
+			b.resolveMember(scope, n)
+			return false
+
+		case *parser.IdentType:
+			b.resolve(scope, &parser.Identifier{NodeBase: n.NodeBase, Value: n.Name}, "unknown type", "")
+
+		case *parser.StructType:
+			for _, field := range n.Fields {
+				if field != nil {
+					b.resolveRefs(scope, field.Type)
+				}
+			}
+			return false
+		}
+		return true
+	})
+}
+
+// blockScope opens a child scope spanning the first block at or after from.
+func (b *symbolBuilder) blockScope(parent *Scope, from Position) *Scope {
+	scope := NewScope(parent)
+	scope.Span, _ = blockSpan(b.toks, from)
+	return scope
+}
 
+func (b *symbolBuilder) buildInScope(scope *Scope, stmts []parser.Statement) {
 	for _, stmt := range stmts {
-		if stmt == nil {
+		if isNilNode(stmt) {
 			continue
 		}
 
@@ -90,56 +678,63 @@ func buildInScope(scope *Scope, stmts []parser.Statement) {
 
 		case *parser.VarStatement:
 			if s.Name == nil {
-				panic("VarStatement.Name is nil")
+				continue
 			}
 
-			log.Printf("DEFINE %s in scope %p\n", s.Name.Value, scope)
-			scope.Define(&Symbol{
+			b.resolveRefs(scope, s.Type)
+			b.resolveRefs(scope, s.Value)
+			b.define(scope, &Symbol{
 				Kind:  SymVar,
 				Name:  s.Name.Value,
 				Ident: s.Name,
+				Decl:  s,
 				Type:  s.Type,
 				Value: s.Value,
 			})
 
 		case *parser.VarStatementNoKeyword:
 			if s.Name == nil {
-				panic("VarStatementNoKeyword.Name is nil")
+				continue
 			}
 
-			log.Printf("DEFINE %s in scope %p\n", s.Name.Value, scope)
-			scope.Define(&Symbol{
+			b.resolveRefs(scope, s.Value)
+			b.define(scope, &Symbol{
 				Kind:  SymVar,
 				Name:  s.Name.Value,
 				Ident: s.Name,
+				Decl:  s,
 				Value: s.Value,
 			})
 
 		case *parser.ConstStatement:
 			if s.Name == nil {
-				panic("ConstStatement.Name is nil")
+				continue
 			}
 
-			log.Printf("DEFINE %s in scope %p\n", s.Name.Value, scope)
-			scope.Define(&Symbol{
+			b.resolveRefs(scope, s.Type)
+			b.resolveRefs(scope, s.Value)
+			b.define(scope, &Symbol{
 				Kind:  SymConst,
 				Name:  s.Name.Value,
 				Ident: s.Name,
+				Decl:  s,
 				Type:  s.Type,
 				Value: s.Value,
 			})
 
 		case *parser.MultiVarStatement:
 			if s.Names == nil {
-				panic("MultiVarStatement.Names is nil")
+				continue
 			}
 
+			b.resolveRefs(scope, s.Type)
+			b.resolveRefs(scope, s.Value)
 			for _, name := range s.Names {
-				log.Printf("DEFINE %s in scope %p\n", name.Value, scope)
-				scope.Define(&Symbol{
+				b.define(scope, &Symbol{
 					Kind:  SymVar,
 					Name:  name.Value,
 					Ident: name,
+					Decl:  s,
 					Type:  s.Type,
 					Value: s.Value,
 				})
@@ -147,113 +742,259 @@ func buildInScope(scope *Scope, stmts []parser.Statement) {
 
 		case *parser.MultiVarStatementNoKeyword:
 			if s.Names == nil {
-				panic("MultiVarStatementNoKeyword.Names is nil")
+				continue
 			}
 
+			b.resolveRefs(scope, s.Value)
 			for _, name := range s.Names {
-				log.Printf("DEFINE %s in scope %p\n", name.Value, scope)
-				scope.Define(&Symbol{
+				b.define(scope, &Symbol{
 					Kind:  SymVar,
 					Name:  name.Value,
 					Ident: name,
+					Decl:  s,
 					Value: s.Value,
 				})
 			}
 
 		case *parser.MultiConstStatement:
 			if s.Names == nil {
-				panic("MultiConstStatement.Names is nil")
+				continue
 			}
 
+			b.resolveRefs(scope, s.Type)
+			b.resolveRefs(scope, s.Value)
 			for _, name := range s.Names {
-				log.Printf("DEFINE %s in scope %p\n", name.Value, scope)
-				scope.Define(&Symbol{
+				b.define(scope, &Symbol{
 					Kind:  SymConst,
 					Name:  name.Value,
 					Ident: name,
+					Decl:  s,
 					Type:  s.Type,
 					Value: s.Value,
 				})
 			}
 
+		case *parser.VarStatementBlock:
+			b.buildInScope(scope, s.Decls)
+
+		case *parser.ConstStatementBlock:
+			b.buildInScope(scope, s.Decls)
+
+		case *parser.AssignmentStatement:
+			b.resolveRefs(scope, s.Value)
+			b.resolveAssigned(scope, s.Name)
+
+		case *parser.MultiAssignmentStatement:
+			b.resolveRefs(scope, s.Value)
+			for _, name := range s.Names {
+				b.resolveAssigned(scope, name)
+			}
+
+		case *parser.IndexAssignmentStatement:
+			b.resolveRefs(scope, s.Left)
+			b.resolveRefs(scope, s.Index)
+			b.resolveRefs(scope, s.Value)
+
+		case *parser.MemberAssignmentStatement:
+			b.resolveRefs(scope, s.Object)
+			b.resolveRefs(scope, s.Value)
+			b.resolveMember(scope, &parser.MemberExpression{
+				NodeBase: s.NodeBase,
+				Left:     s.Object,
+				Field:    s.Field,
+			})
+
+		case *parser.ExpressionStatement:
+			b.resolveRefs(scope, s.Expression)
+
+		case *parser.ReturnStatement:
+			for _, value := range s.Values {
+				b.resolveRefs(scope, value)
+			}
+
 		case *parser.FuncStatement:
 			if s.Name == nil {
-				panic("FuncStatement.Name is nil")
+				continue
 			}
 
 			fnSym := &Symbol{
 				Kind:  SymFunc,
 				Name:  s.Name.Value,
 				Ident: s.Name,
+				Decl:  s,
 			}
-			log.Printf("DEFINE %s in scope %p\n", s.Name.Value, scope)
-			scope.Define(fnSym)
+			for _, ret := range s.ReturnTypes {
+				if ret == nil {
+					continue
+				}
+				fnSym.Returns = append(fnSym.Returns, &parser.IdentType{
+					NodeBase: ret.NodeBase,
+					Name:     ret.Value,
+				})
+			}
+			b.define(scope, fnSym)
 
-			// function scope
-			fnScope := NewScope(scope)
+			// function scope, covering the params and the body
+			fnScope := b.blockScope(scope, identRange(s.Name).End)
+			fnScope.Span.Start = identRange(s.Name).End
+			fnScope.Owner = fnSym
 
 			// params
 			for _, p := range s.Params {
-				log.Printf("DEFINE %s in scope %p\n", p.Token.Literal, scope)
-				fnScope.Define(&Symbol{
-					Kind:  SymParam,
-					Name:  p.Name.Value,
-					Ident: p.Name,
-					Type:  p.Type,
-				})
+				if p == nil || p.Name == nil {
+					continue
+				}
+
+				b.resolveRefs(scope, p.Type)
+
+				param := &Symbol{
+					Kind:   SymParam,
+					Name:   p.Name.Value,
+					Ident:  p.Name,
+					Decl:   p,
+					Type:   p.Type,
+					Parent: fnSym,
+				}
+				fnSym.Params = append(fnSym.Params, param)
+				b.define(fnScope, param)
 			}
 
-			buildInScope(fnScope, s.Body)
+			body := s.Body
+			b.pending = append(b.pending, func() {
+				b.buildInScope(fnScope, body)
+			})
 
 		case *parser.TypeStatement:
 			if s.Name == nil {
-				panic("TypeStatement.Name is nil")
+				continue
 			}
 
-			var typeName string
-
-			switch t := s.Type.(type) {
-			case *parser.IdentType:
-				typeName = t.Name
+			b.define(scope, &Symbol{
+				Kind:  SymUserType,
+				Name:  s.Name.Value,
+				Ident: s.Name,
+				Decl:  s,
+				Type:  s.Type,
+			})
 
-			case *parser.StructType:
-				var fieldNames string
-				for _, field := range t.Fields {
-					fieldNames += field.Name.Value + "\n"
-				}
-				typeName = fmt.Sprintf("struct {\n%s}", fieldNames)
+			// defined first so a struct may refer to itself
+			b.resolveRefs(scope, s.Type)
 
-			default:
-				panic(fmt.Sprintf("unknown TypeStatement.Type: %T", s.Type))
+		case *parser.EnumStatement:
+			if s.Name == nil {
+				continue
 			}
 
-			log.Printf("DEFINE %s in scope %p\n", s.Name.Value, scope)
-			scope.Define(&Symbol{
+			b.define(scope, &Symbol{
 				Kind:  SymUserType,
 				Name:  s.Name.Value,
 				Ident: s.Name,
+				Decl:  s,
 				Type: &parser.IdentType{
 					NodeBase: s.NodeBase,
-					Name:    typeName,
+					Name:     "enum",
 				},
 			})
 
 		case *parser.ForStatement:
-			loopScope := NewScope(scope)
+			// the loop scope starts at the init so it covers the header
+			loopScope := b.blockScope(scope, tokenSpan(s.Token).Start)
+			loopScope.Span.Start = tokenSpan(s.Token).Start
 
 			if s.Init != nil {
-				buildInScope(loopScope, []parser.Statement{s.Init})
+				b.buildInScope(loopScope, []parser.Statement{s.Init})
+			}
+			b.resolveRefs(loopScope, s.Condition)
+			if s.Post != nil {
+				b.buildInScope(loopScope, []parser.Statement{s.Post})
 			}
-			buildInScope(loopScope, s.Body)
+			b.buildInScope(loopScope, s.Body)
+
+		case *parser.ForRangeStatement:
+			b.resolveRefs(scope, s.Expr)
+
+			loopScope := b.blockScope(scope, tokenSpan(s.Token).Start)
+
+			if s.Key != nil {
+				loopScope.Span.Start = identRange(s.Key).Start
+			} else {
+				loopScope.Span.Start = tokenSpan(s.Token).Start
+			}
+
+			for _, ident := range []*parser.Identifier{s.Key, s.Value} {
+				if ident == nil || ident.Value == "_" {
+					continue
+				}
+
+				b.define(loopScope, &Symbol{
+					Kind:  SymVar,
+					Name:  ident.Value,
+					Ident: ident,
+					Decl:  s,
+				})
+			}
+
+			b.buildInScope(loopScope, s.Body)
 
 		case *parser.WhileStatement:
-			loopScope := NewScope(scope)
-			buildInScope(loopScope, s.Body)
+			b.resolveRefs(scope, s.Condition)
+
+			loopScope := b.blockScope(scope, tokenSpan(s.Token).Start)
+			b.buildInScope(loopScope, s.Body)
 
 		case *parser.IfStatement:
-			buildInScope(NewScope(scope), s.Consequence)
-			if s.Alternative != nil {
-				buildInScope(NewScope(scope), s.Alternative)
+			b.resolveRefs(scope, s.Condition)
+
+			consScope := b.blockScope(scope, tokenSpan(s.Token).Start)
+			b.buildInScope(consScope, s.Consequence)
+
+			if s.Alternative == nil {
+				continue
+			}
+
+			// an else-if chain has no braces of its own, the nested if
+			// opens its own scopes
+			altSpan, _ := blockSpan(b.toks, consScope.Span.End)
+			if len(s.Alternative) == 1 {
+				if elseIf, ok := s.Alternative[0].(*parser.IfStatement); ok &&
+					posBefore(tokenSpan(elseIf.Token).Start, altSpan.Start) {
+					b.buildInScope(scope, s.Alternative)
+					continue
+				}
+			}
+
+			altScope := NewScope(scope)
+			altScope.Span = altSpan
+			b.buildInScope(altScope, s.Alternative)
+
+		case *parser.SpawnStatement:
+			b.buildInScope(b.blockScope(scope, tokenSpan(s.Token).Start), s.Body)
+
+		case *parser.WithStatement:
+			b.resolveRefs(scope, s.Expr)
+
+			withScope := b.blockScope(scope, tokenSpan(s.Token).Start)
+			// the value is bound to an implicit const
+			b.define(withScope, &Symbol{
+				Kind:  SymConst,
+				Name:  "it",
+				Value: s.Expr,
+			})
+			b.buildInScope(withScope, s.Body)
+
+		case *parser.SwitchStatement:
+			b.resolveRefs(scope, s.Value)
+
+			for _, c := range s.Cases {
+				if c == nil {
+					continue
+				}
+				b.resolveRefs(scope, c.Expr)
+				b.buildInScope(b.blockScope(scope, tokenSpan(c.Token).Start), c.Body)
+			}
+
+			if s.Default != nil {
+				b.buildInScope(b.blockScope(scope, tokenSpan(s.Default.Token).Start), s.Default.Body)
 			}
 
 		}
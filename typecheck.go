@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/z-sk1/ayla-lang/parser"
+	"github.com/z-sk1/ayla-lang/token"
+)
+
+// TypeError is a type mismatch found once symbols are resolved, reported
+// over the expression or statement it concerns.
+type TypeError struct {
+	Message string
+	Range   Range
+
+	// Code names the kind of error for the errors quick fixes exist for
+	Code string
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("type error at %d:%d: %s", e.Range.Start.Line+1, e.Range.Start.Character+1, e.Message)
+}
+
+type typeChecker struct {
+	*tokenIndex
+	root   *Scope
+	errors []*TypeError
+
+	// symbols finds the symbol an identifier token declares or refers to
+	symbols map[token.Token]*Symbol
+}
+
+// checkTypes reports the type errors in a program whose symbols have been
+// built, inferred and indexed. expressions whose type is not known are never
+// errors.
+func checkTypes(program []parser.Statement, toks []token.Token, root *Scope, symbols map[token.Token]*Symbol) []*TypeError {
+	c := &typeChecker{
+		tokenIndex: newTokenIndex(toks),
+		root:       root,
+		symbols:    symbols,
+	}
+
+	for _, stmt := range program {
+		c.check(stmt, nil)
+	}
+
+	return c.errors
+}
+
+func (c *typeChecker) errorf(r Range, format string, args ...interface{}) *TypeError {
+	err := &TypeError{
+		Message: fmt.Sprintf(format, args...),
+		Range:   r,
+	}
+	c.errors = append(c.errors, err)
+	return err
+}
+
+// typeOf infers the type of expr in the scope it appears in.
+func (c *typeChecker) typeOf(expr parser.Expression) parser.TypeNode {
+	if isNilNode(expr) {
+		return nil
+	}
+	return inferExprType(c.root.ScopeAt(c.nodeRange(expr).Start), expr)
+}
+
+// check checks the statement or expression n and everything nested in it.
+// fn is the function whose body n is in, or nil at the top level.
+func (c *typeChecker) check(n parser.Node, fn *Symbol) {
+	inspect(n, func(n parser.Node) bool {
+		switch n := n.(type) {
+
+		case *parser.FuncStatement:
+			if n.Name == nil {
+				return false
+			}
+			inner := c.symbols[n.Name.Token]
+			for _, stmt := range n.Body {
+				c.check(stmt, inner)
+			}
+			return false
+
+		case *parser.VarStatement:
+			if n.Name != nil {
+				c.checkAssign(n.Type, n.Value, "declaration of "+n.Name.Value)
+			}
+
+		case *parser.ConstStatement:
+			if n.Name != nil {
+				c.checkAssign(n.Type, n.Value, "declaration of "+n.Name.Value)
+			}
+
+		case *parser.AssignmentStatement:
+			if sym := c.symbols[n.Name.Token]; sym != nil {
+				c.checkAssign(sym.Type, n.Value, "assignment to "+n.Name.Value)
+			}
+
+		case *parser.MemberAssignmentStatement:
+			if sym := c.symbols[n.Field.Token]; sym != nil {
+				c.checkAssign(sym.Type, n.Value, "assignment to field "+n.Field.Value)
+			}
+
+		case *parser.IfStatement:
+			c.checkCondition(n.Condition)
+
+		case *parser.WhileStatement:
+			c.checkCondition(n.Condition)
+
+		case *parser.ForStatement:
+			c.checkCondition(n.Condition)
+
+		case *parser.ReturnStatement:
+			c.checkReturn(n, fn)
+
+		case *parser.FuncCall:
+			c.checkCall(n)
+
+		case *parser.StructLiteral:
+			c.checkStructLiteral(n)
+
+		case *parser.InfixExpression:
+			left, right := c.typeOf(n.Left), c.typeOf(n.Right)
+			if _, msg := infixType(n.Operator, left, right); msg != "" {
+				c.errorf(c.nodeRange(n), "%s", msg)
+			}
+
+		case *parser.PrefixExpression:
+			if _, msg := prefixType(n.Operator, c.typeOf(n.Right)); msg != "" {
+				c.errorf(c.nodeRange(n), "%s", msg)
+			}
+		}
+		return true
+	})
+}
+
+// checkAssign reports value when it cannot be stored in a place of type to.
+func (c *typeChecker) checkAssign(to parser.TypeNode, value parser.Expression, context string) {
+	if to == nil || isNilNode(value) {
+		return
+	}
+
+	from := c.typeOf(value)
+	if !c.assignable(to, from) {
+		c.errorf(c.nodeRange(value), "cannot use %s as %s in %s",
+			typeNodeToString(from), typeNodeToString(to), context)
+	}
+}
+
+func (c *typeChecker) checkCondition(cond parser.Expression) {
+	if isNilNode(cond) {
+		return
+	}
+
+	if t := c.typeOf(cond); t != nil && !isIdent(t, "bool") && !isIdent(t, "thing") {
+		c.errorf(c.nodeRange(cond), "non-bool condition of type %s", typeNodeToString(t))
+	}
+}
+
+func (c *typeChecker) checkReturn(ret *parser.ReturnStatement, fn *Symbol) {
+	// functions without return types may give back anything
+	if fn == nil || len(fn.Returns) == 0 {
+		return
+	}
+
+	var have []parser.TypeNode
+	for _, value := range ret.Values {
+		have = append(have, c.typeOf(value))
+	}
+
+	// a single call may give back all the values at once
+	if len(ret.Values) == 1 {
+		if call, ok := ret.Values[0].(*parser.FuncCall); ok {
+			if callee := c.symbols[call.Name.Token]; callee != nil && callee.Kind == SymFunc && len(funcReturns(callee)) > 1 {
+				have = funcReturns(callee)
+			}
+		}
+	}
+
+	if len(have) != len(fn.Returns) {
+		c.errorf(c.nodeRange(ret), "wrong number of return values (have %d, want %d)", len(have), len(fn.Returns))
+		return
+	}
+
+	for i, want := range fn.Returns {
+		if !c.assignable(want, have[i]) {
+			at := c.nodeRange(ret)
+			if len(ret.Values) == len(have) {
+				at = c.nodeRange(ret.Values[i])
+			}
+			c.errorf(at, "cannot use %s as %s in return value %d", typeNodeToString(have[i]), typeNodeToString(want), i+1)
+		}
+	}
+}
+
+func (c *typeChecker) checkCall(call *parser.FuncCall) {
+	fn := c.symbols[call.Name.Token]
+	if fn == nil || fn.Kind != SymFunc {
+		return
+	}
+
+	have, want := len(call.Args), len(fn.Params)
+	switch {
+	case fn.Variadic && have < want-1:
+		c.errorf(c.nodeRange(call), "not enough arguments in call to %s (have %d, want at least %d)", fn.Name, have, want-1).Code = codeArgCount
+		return
+	case !fn.Variadic && have < want:
+		c.errorf(c.nodeRange(call), "not enough arguments in call to %s (have %d, want %d)", fn.Name, have, want).Code = codeArgCount
+		return
+	case !fn.Variadic && have > want:
+		c.errorf(c.nodeRange(call), "too many arguments in call to %s (have %d, want %d)", fn.Name, have, want).Code = codeArgCount
+		return
+	}
+
+	for i, arg := range call.Args {
+		p := activeParam(fn, i)
+		if p < 0 || isNilNode(arg) {
+			continue
+		}
+
+		to, from := fn.Params[p].Type, c.typeOf(arg)
+		if to != nil && !c.assignable(to, from) {
+			c.errorf(c.nodeRange(arg), "cannot use %s as %s in argument %d to %s",
+				typeNodeToString(from), typeNodeToString(to), i+1, fn.Name)
+		}
+	}
+}
+
+func (c *typeChecker) checkStructLiteral(lit *parser.StructLiteral) {
+	if lit.TypeName == nil {
+		return
+	}
+
+	scope := c.root.ScopeAt(identRange(lit.TypeName).Start)
+	fields := typeFieldsOf(scope, &parser.IdentType{Name: lit.TypeName.Value}, 0)
+
+	for _, name := range sortedKeys(lit.Fields) {
+		if field, ok := fields[name]; ok {
+			c.checkAssign(field.Type, lit.Fields[name], "field "+name+" of "+lit.TypeName.Value)
+		}
+	}
+}
+
+// basicTypes are the builtin types values can be checked against.
+var basicTypes = map[string]bool{"int": true, "float": true, "string": true, "bool": true}
+
+func basicName(t parser.TypeNode) string {
+	if id, ok := t.(*parser.IdentType); ok && basicTypes[id.Name] {
+		return id.Name
+	}
+	return ""
+}
+
+// assignable reports whether a value of type from can be stored in a place
+// of type to. whenever either type is not fully known it says yes.
+func (c *typeChecker) assignable(to, from parser.TypeNode) bool {
+	if to == nil || from == nil || isIdent(to, "thing") || isIdent(from, "thing") {
+		return true
+	}
+
+	switch to := to.(type) {
+	case *parser.ArrayType:
+		switch from := from.(type) {
+		case *parser.ArrayType:
+			return c.assignable(to.Elem, from.Elem)
+		case *parser.IdentType:
+			return basicName(from) == ""
+		}
+		return true
+
+	case *parser.IdentType:
+		if _, ok := from.(*parser.ArrayType); ok {
+			return to.Name == "arr" || basicName(to) == ""
+		}
+
+		fromID, ok := from.(*parser.IdentType)
+		if !ok {
+			return true
+		}
+
+		switch {
+		case to.Name == fromID.Name:
+			return true
+		case basicName(to) != "" && basicName(fromID) != "":
+			return to.Name == "float" && fromID.Name == "int"
+		}
+
+		// struct types are nominal, other named types are left alone
+		if c.isStructType(to.Name) && c.isStructType(fromID.Name) {
+			return false
+		}
+		if basicName(to) != "" && c.isStructType(fromID.Name) ||
+			basicName(fromID) != "" && c.isStructType(to.Name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *typeChecker) isStructType(name string) bool {
+	sym := c.root.Resolve(name)
+	if sym == nil || sym.Kind != SymUserType {
+		return false
+	}
+	_, ok := sym.Type.(*parser.StructType)
+	return ok
+}
+
+// infixType returns the type of left op right, along with a message when
+// the operands do not fit the operator. nil means the type is unknown.
+func infixType(op string, left, right parser.TypeNode) (parser.TypeNode, string) {
+	boolType := &parser.IdentType{Name: "bool"}
+
+	switch op {
+	case "&&", "||":
+		for _, t := range []parser.TypeNode{left, right} {
+			if t != nil && !isIdent(t, "bool") && !isIdent(t, "thing") {
+				return boolType, fmt.Sprintf("operator %s not defined on %s", op, typeNodeToString(t))
+			}
+		}
+		return boolType, ""
+	}
+
+	comparison := op == "==" || op == "!=" || op == "<" || op == ">" || op == "<=" || op == ">="
+
+	if left == nil || right == nil {
+		if comparison {
+			return boolType, ""
+		}
+		return nil, ""
+	}
+
+	if isIdent(left, "thing") || isIdent(right, "thing") {
+		return nil, "cannot use thing in operations, assert a type first"
+	}
+
+	l, r := basicName(left), basicName(right)
+	if l == "" || r == "" {
+		if comparison {
+			return boolType, ""
+		}
+		if sameTypeNode(left, right) {
+			return left, ""
+		}
+		return nil, ""
+	}
+
+	numeric := (l == "int" || l == "float") && (r == "int" || r == "float")
+	if l != r && !numeric {
+		return nil, fmt.Sprintf("mismatched types %s and %s", l, r)
+	}
+
+	switch {
+	case comparison && (op == "==" || op == "!=" || numeric):
+		return boolType, ""
+
+	case numeric && op == "%":
+		if l == "float" || r == "float" {
+			return nil, "operator % not defined on float"
+		}
+		return left, ""
+
+	case numeric && op == "/":
+		return &parser.IdentType{Name: "float"}, ""
+
+	case numeric && (op == "+" || op == "-" || op == "*"):
+		if l == "float" || r == "float" {
+			return &parser.IdentType{Name: "float"}, ""
+		}
+		return left, ""
+
+	case l == "string" && op == "+":
+		return left, ""
+	}
+
+	return nil, fmt.Sprintf("operator %s not defined on %s", op, l)
+}
+
+// prefixType returns the type of op right, along with a message when the
+// operand does not fit the operator.
+func prefixType(op string, right parser.TypeNode) (parser.TypeNode, string) {
+	switch op {
+	case "!":
+		if right != nil && !isIdent(right, "bool") && !isIdent(right, "thing") {
+			return &parser.IdentType{Name: "bool"}, fmt.Sprintf("operator ! not defined on %s", typeNodeToString(right))
+		}
+		return &parser.IdentType{Name: "bool"}, ""
+
+	case "-":
+		if name := basicName(right); name == "string" || name == "bool" {
+			return nil, fmt.Sprintf("operator - not defined on %s", name)
+		}
+	}
+	return right, ""
+}